@@ -1,23 +1,91 @@
 package lisp
 
-// Atom is the primitive symbolic type.
-type Atom struct {
+import "sync"
+
+// symbol is the identity of an atom.  Atoms with the same name share one
+// symbol, so atoms can be compared (and used as map keys) by pointer.
+type symbol struct {
 	s string
+	// For a protected atom (see protected), the symbol of the atom it
+	// stands for:
+	orig *symbol
+}
+
+// Atom is the primitive symbolic type.  Make atoms with Intern.
+type Atom struct {
+	*symbol
+}
+
+// symbols is the table of interned symbols, by name.
+var symbols = struct {
+	sync.Mutex
+	m map[string]*symbol
+}{m: map[string]*symbol{}}
+
+// Intern returns the atom with the given name.
+func Intern(s string) Atom {
+	symbols.Lock()
+	defer symbols.Unlock()
+	sym, ok := symbols.m[s]
+	if !ok {
+		sym = &symbol{s: s}
+		symbols.m[s] = sym
+	}
+	return Atom{sym}
+}
+
+// uninterned returns a new atom which is not equal to any other atom, even
+// one with the same name.
+func uninterned(s string) Atom {
+	return Atom{&symbol{s: s}}
+}
+
+// protectedAtoms holds the protected atom for each symbol, once made.
+var protectedAtoms = struct {
+	sync.Mutex
+	m map[*symbol]*symbol
+}{m: map[*symbol]*symbol{}}
+
+// protected returns the protected counterpart of an atom.  It prints, and
+// compares with Equal, like the original, but local bindings of the
+// original don't capture it: a reference to it that isn't bound to the
+// protected atom itself refers to the global definition.  syntax-quote
+// protects the names of global functions this way, so that macro
+// expansions can't be affected by bindings at the call site.
+func protected(a Atom) Atom {
+	a = a.global()
+	protectedAtoms.Lock()
+	defer protectedAtoms.Unlock()
+	sym, ok := protectedAtoms.m[a.symbol]
+	if !ok {
+		sym = &symbol{a.s, a.symbol}
+		protectedAtoms.m[a.symbol] = sym
+	}
+	return Atom{sym}
+}
+
+// global returns the atom a protected atom stands for, or the atom itself
+// if it isn't protected.
+func (a Atom) global() Atom {
+	if a.orig != nil {
+		return Atom{a.orig}
+	}
+	return a
 }
 
 func (a Atom) String() string {
 	return a.s
 }
 
-// Equal returns true if the receiver and the arg are both atoms and have the
-// same name
+// Equal returns true if the receiver and the arg are the same atom, or
+// protected versions of it.
 func (a Atom) Equal(b Sexpr) bool {
 	if b, ok := b.(Atom); ok {
-		return a.s == b.s
+		return a.global() == b.global()
 	}
 	return false
 }
 
 // True is the generic truthy item.  Everything but Nil is true.  See also Nil
 // in cons.go.
-var True Atom = Atom{"t"}
+var True Atom = Intern("t")
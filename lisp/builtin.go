@@ -2,7 +2,9 @@ package lisp
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"math/big"
 	"math/rand"
 	"os"
 	"reflect"
@@ -16,20 +18,20 @@ import (
 
 func InitGlobals() Env {
 	globals := mkEnv(nil)
-	globals.Set("SPACE", Atom{" "})
-	globals.Set("NEWLINE", Atom{"\n"})
-	globals.Set("TAB", Atom{"\t"})
-	globals.Set("BANG", Atom{"!"})
-	globals.Set("QMARK", Atom{"?"})
-	globals.Set("PERIOD", Atom{"."})
-	globals.Set("COMMA", Atom{","})
-	globals.Set("COLON", Atom{":"})
-	globals.Set("HASH", Atom{"#"})
-	globals.Set("ATSIGN", Atom{"@"})
-	globals.Set("CHECK", Atom{"✓"})
-	globals.Set("QUOTE", Atom{"'"})
-	globals.Set("BQUOTE", Atom{"`"})
-	globals.Set("DQUOTE", Atom{"\""})
+	globals.Set("SPACE", Intern(" "))
+	globals.Set("NEWLINE", Intern("\n"))
+	globals.Set("TAB", Intern("\t"))
+	globals.Set("BANG", Intern("!"))
+	globals.Set("QMARK", Intern("?"))
+	globals.Set("PERIOD", Intern("."))
+	globals.Set("COMMA", Intern(","))
+	globals.Set("COLON", Intern(":"))
+	globals.Set("HASH", Intern("#"))
+	globals.Set("ATSIGN", Intern("@"))
+	globals.Set("CHECK", Intern("✓"))
+	globals.Set("QUOTE", Intern("'"))
+	globals.Set("BQUOTE", Intern("`"))
+	globals.Set("DQUOTE", Intern("\""))
 	return globals
 }
 
@@ -57,6 +59,11 @@ type Builtin struct {
 	Doc      *ConsCell
 	Args     *ConsCell
 	Examples *ConsCell
+	// If set, ctl is used instead of Fn, for builtins which need to
+	// manipulate the VM directly.  The builtin is at stack[base], with its
+	// arguments above it; ctl must leave the result of the call in place of
+	// them, or arrange for it to be delivered later.
+	ctl func(m *vm, base int, tail bool) error
 }
 
 func (b Builtin) String() string {
@@ -111,56 +118,34 @@ func applyFn(args []Sexpr, env *Env) (Sexpr, error) {
 	if !ok {
 		return nil, baseError(fmt.Sprintf("'%s' is not a list", args[l-1]))
 	}
-	asCons, err := consToExprs(c)
+	asCons, err := consToExprsIn(c, env)
 	if err != nil {
 		return nil, extendError("apply", err)
 	}
 	fnArgs = append(singleArgs, asCons...)
 
-	// Note: what follows is very similar to the function evaluation
-	// logic in eval(), but TCO (goto) there makes it hard to DRY out with
-	// respect to what follows.
-
-	evalCar := args[0]
-	// User-defined functions:
-	lambda, ok := evalCar.(*lambdaFn)
-	if ok {
-		newEnv := mkEnv(lambda.env)
-		err := setLambdaArgsInEnv(&newEnv, lambda, fnArgs)
-		if err != nil {
-			return nil, extendError("apply", err)
-		}
-		var ret Sexpr = Nil
-		bodyExpr := lambda.body
-		for {
-			if bodyExpr == Nil {
-				return ret, nil
-			}
-			ret, err = eval(bodyExpr.car, &newEnv)
-			if err != nil {
-				return nil, extendError("apply", err)
-			}
-			bodyExpr = bodyExpr.cdr.(*ConsCell)
-		}
-	}
-	// Built-in functions:
-	builtin, ok := evalCar.(*Builtin)
-	if !ok {
-		return nil, baseError(fmt.Sprintf("%s is not a function", evalCar))
-	}
-	biResult, err := builtin.Fn(fnArgs, env)
+	ret, err := callFn(args[0], fnArgs, env)
 	if err != nil {
 		return nil, extendError("apply", err)
 	}
-	return biResult, nil
+	return ret, nil
 }
 
 func LoadFile(e *Env, filename string) error {
+	return loadFile(threadOf(e), e, filename)
+}
+
+// LoadFileContext is like LoadFile, with limits as for EvalExprsContext.
+func LoadFileContext(ctx context.Context, e *Env, filename string, maxSteps int) error {
+	return loadFile(limitedThread(ctx, maxSteps), e, filename)
+}
+
+func loadFile(th *thread, e *Env, filename string) error {
 	bytes, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	err = LexParseEval(string(bytes), e)
+	err = lexParseEval(th, string(bytes), e)
 	if err != nil {
 		return err
 	}
@@ -170,10 +155,13 @@ func LoadFile(e *Env, filename string) error {
 // moving `builtins` into `init` avoids initialization loop for doHelp:
 var builtins map[string]*Builtin
 
+// builtinAtoms indexes the builtins by atom, for the VM:
+var builtinAtoms = map[Atom]*Builtin{}
+
 func init() {
 	// Helper functions to DRY out examples and args:
 	A := func(s string) Atom {
-		return Atom{s}
+		return Intern(s)
 	}
 	N := func(n int) Number {
 		return Num(n)
@@ -197,7 +185,7 @@ func init() {
 	}
 	C := func(a, b Sexpr) *ConsCell { return Cons(a, b) }
 	RO := func(s string) *ConsCell {
-		return Cons(Nil, Atom{s})
+		return Cons(Nil, Intern(s))
 	}
 	DOC := func(s string) *ConsCell {
 		return convertStringToDoc(capitalize(s))
@@ -328,12 +316,17 @@ func init() {
 				LE(A("="), N(1), N(2)),
 				LE(A("apply"), A("="), LE(A("repeat"), N(10), A("t"))),
 			),
-			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
 				if len(args) < 1 {
 					return nil, baseError("missing argument")
 				}
+				lim := threadOf(e).lim
 				for _, arg := range args[1:] {
-					if !args[0].Equal(arg) {
+					eq, err := equal(args[0], arg, e, lim)
+					if err != nil {
+						return nil, err
+					}
+					if !eq {
 						return Nil, nil
 					}
 				}
@@ -447,7 +440,7 @@ func init() {
 				LE(A("apply"), A("+"), LE(A("repeat"), N(10), N(1))),
 				LE(A("apply"), A("*"), LE(A("cdr"), LE(A("range"), N(10)))),
 			),
-			Fn: applyFn,
+			ctl: applyCtl,
 		},
 		"atom?": {
 			Name:       "atom?",
@@ -489,6 +482,29 @@ func init() {
 				return l.body, nil
 			},
 		},
+		"call-with-current-continuation": {
+			Name:       "call-with-current-continuation",
+			Doc:        DOC("Same as call/cc"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("f")),
+			Examples: E(
+				LE(A("call-with-current-continuation"), LE(A("lambda"), LE(A("k")), LE(A("+"), N(1), LE(A("k"), N(2))))),
+			),
+			ctl: callCC,
+		},
+		"call/cc": {
+			Name:       "call/cc",
+			Doc:        DOC("Call f with the current continuation k; calling k returns its argument from call/cc"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("f")),
+			Examples: E(
+				LE(A("call/cc"), LE(A("lambda"), LE(A("k")), N(1))),
+				LE(A("+"), N(1), LE(A("call/cc"), LE(A("lambda"), LE(A("k")), LE(A("k"), N(2)), N(3)))),
+			),
+			ctl: callCC,
+		},
 		"car": {
 			Name:       "car",
 			Doc:        DOC("Return the first element of a list"),
@@ -524,7 +540,7 @@ func init() {
 				LE(A("cdr"), QL(A("one"), A("two"))),
 				LE(A("cdr"), LE()),
 			),
-			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
 				if len(args) != 1 {
 					return nil, baseError("missing argument")
 				}
@@ -535,7 +551,56 @@ func init() {
 				if cdrCons == Nil {
 					return Nil, nil
 				}
-				return cdrCons.cdr, nil
+				return forceTail(cdrCons.cdr, e)
+			},
+		},
+		"chan": {
+			Name:       "chan",
+			Doc:        DOC("Make a channel for passing values between tasks, with room for n values (default 0) waiting to be received"),
+			FixedArity: 0,
+			NAry:       true,
+			Args:       RO("n"),
+			Examples: E(
+				LE(A("chan")),
+				LE(A("let"), LE(LE(A("c"), LE(A("chan"), N(1)))),
+					LE(A("send"), A("c"), QA("hello")),
+					LE(A("recv"), A("c"))),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				switch len(args) {
+				case 0:
+					return &channel{make(chan Sexpr)}, nil
+				case 1:
+					n, ok := args[0].(Number)
+					if !ok || n.Less(Num(0)) || n.Greater(Num(maxChanSize)) {
+						return nil, baseErrorf("'%s' is not a valid channel size", args[0])
+					}
+					return &channel{make(chan Sexpr, n.int())}, nil
+				}
+				return nil, baseError("chan expects at most one argument")
+			},
+		},
+		"close": {
+			Name:       "close",
+			Doc:        DOC("Close a channel; receiving from it returns () once any values waiting in it are received"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("c")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("c"), LE(A("chan"), N(1)))),
+					LE(A("send"), A("c"), N(1)),
+					LE(A("close"), A("c")),
+					LE(A("list"), LE(A("recv"), A("c")), LE(A("recv"), A("c")))),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("close expects a single argument")
+				}
+				c, err := asChannel(args[0])
+				if err != nil {
+					return nil, err
+				}
+				return Nil, c.close()
 			},
 		},
 		"cons": {
@@ -556,6 +621,48 @@ func init() {
 				return Cons(args[0], args[1]), nil
 			},
 		},
+		"deliver": {
+			Name:       "deliver",
+			Doc:        DOC("Supply the value of a promise, waking anything waiting for it with deref"),
+			FixedArity: 2,
+			NAry:       false,
+			Args:       LC(A("p"), A("x")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("p"), LE(A("promise")))),
+					LE(A("deliver"), A("p"), N(3)),
+					LE(A("deref"), A("p"))),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				if len(args) != 2 {
+					return nil, baseError("deliver expects two arguments")
+				}
+				p, ok := args[0].(*promise)
+				if !ok {
+					return nil, baseErrorf("'%s' is not a promise", args[0])
+				}
+				if err := p.deliver(args[1]); err != nil {
+					return nil, err
+				}
+				return args[1], nil
+			},
+		},
+		"deref": {
+			Name:       "deref",
+			Doc:        DOC("Wait for the value of a future or promise, or force a delay"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("x")),
+			Examples: E(
+				LE(A("deref"), LE(A("future"), LE(A("+"), N(1), N(2)))),
+				LE(A("map"), A("deref"), LE(A("map"), LE(A("lambda"), LE(A("n")), LE(A("future"), LE(A("*"), A("n"), A("n")))), LE(A("range"), N(5)))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("deref expects a single argument")
+				}
+				return deref(args[0], e)
+			},
+		},
 		"doc": {
 			Name:       "doc",
 			Doc:        DOC("Return the doclist for a function"),
@@ -578,11 +685,39 @@ func init() {
 					return t.doc, nil
 				case *Builtin:
 					return t.Doc.car, nil
+				case *multiFn:
+					return t.docList(), nil
 				default:
 					return nil, baseErrorf("'%s' is not a function", args[0])
 				}
 			},
 		},
+		"done?": {
+			Name:       "done?",
+			Doc:        DOC("Return t if a generator's body has finished, () otherwise"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("g")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("g"), LE(A("generator"), LE(A("yield"), N(1))))),
+					LE(A("next"), A("g")),
+					LE(A("next"), A("g")),
+					LE(A("done?"), A("g"))),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("done? expects a single argument")
+				}
+				g, ok := args[0].(*generator)
+				if !ok {
+					return nil, baseErrorf("'%s' is not a generator", args[0])
+				}
+				if g.finished() {
+					return True, nil
+				}
+				return Nil, nil
+			},
+		},
 		"downcase": {
 			Name:       "downcase",
 			Doc:        DOC("Return a new atom with all characters in lower case"),
@@ -601,26 +736,117 @@ func init() {
 				if !ok {
 					return nil, baseErrorf("expected atom, got '%s'", args[0])
 				}
-				return Atom{strings.ToLower(a.s)}, nil
+				return Intern(strings.ToLower(a.s)), nil
 			},
 		},
-		"eval": {
-			Name:       "eval",
-			Doc:        DOC("Evaluate an expression"),
+		"env-bound?": {
+			Name:       "env-bound?",
+			Doc:        DOC("Return t if the symbol is bound in the environment, () otherwise"),
+			FixedArity: 2,
+			NAry:       false,
+			Args:       LC(A("env"), A("x")),
+			Examples: E(
+				LE(A("env-bound?"), LE(A("the-environment")), QA("car")),
+				LE(A("env-bound?"), LE(A("make-env")), QA("a")),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				env, name, err := envAndName("env-bound?", args, 2)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := lookup(name, env); err != nil {
+					return Nil, nil
+				}
+				return True, nil
+			},
+		},
+		"env-get": {
+			Name:       "env-get",
+			Doc:        DOC("Return the value of a symbol in an environment"),
+			FixedArity: 2,
+			NAry:       false,
+			Args:       LC(A("env"), A("x")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("a"), N(1))),
+					LE(A("env-get"), LE(A("the-environment")), QA("a"))),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				env, name, err := envAndName("env-get", args, 2)
+				if err != nil {
+					return nil, err
+				}
+				return lookup(name, env)
+			},
+		},
+		"env-keys": {
+			Name:       "env-keys",
+			Doc:        DOC("Return the symbols bound in an environment and its parents, in sorted order"),
 			FixedArity: 1,
 			NAry:       false,
-			Args:       LC(A("x")),
+			Args:       LC(A("env")),
 			Examples: E(
-				LE(A("eval"), QL(A("one"), A("two"))),
-				LE(A("eval"), QL(A("+"), N(1), N(2))),
+				LE(A("env-keys"), LE(A("make-env"))),
+				LE(A("let"), LE(LE(A("e"), LE(A("make-env")))),
+					LE(A("env-set!"), A("e"), QA("b"), N(2)),
+					LE(A("env-set!"), A("e"), QA("a"), N(1)),
+					LE(A("env-keys"), A("e"))),
 			),
-			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
 				if len(args) != 1 {
-					return nil, baseError("missing argument")
+					return nil, baseError("env-keys expects a single argument")
 				}
-				return eval(args[0], e)
+				env, ok := args[0].(*Env)
+				if !ok {
+					return nil, baseErrorf("'%s' is not an environment", args[0])
+				}
+				keys := EnvKeys(env)
+				sort.Strings(keys)
+				ret := []Sexpr{}
+				for i, k := range keys {
+					if i == 0 || k != keys[i-1] {
+						ret = append(ret, Intern(k))
+					}
+				}
+				return mkListAsConsWithCdr(ret, Nil), nil
 			},
 		},
+		"env-set!": {
+			Name:       "env-set!",
+			Doc:        DOC("Bind a symbol to a value in an environment, returning the value"),
+			FixedArity: 3,
+			NAry:       false,
+			Args:       LC(A("env"), A("x"), A("value")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("e"), LE(A("make-env")))),
+					LE(A("env-set!"), A("e"), QA("a"), N(1)),
+					LE(A("eval"), QL(A("+"), A("a"), N(1)), A("e"))),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				env, name, err := envAndName("env-set!", args, 3)
+				if err != nil {
+					return nil, err
+				}
+				noteBinding(env, name, args[2])
+				if err := env.set(name, args[2]); err != nil {
+					return nil, err
+				}
+				return args[2], nil
+			},
+		},
+		"eval": {
+			Name:       "eval",
+			Doc:        DOC("Evaluate an expression, in the given environment if one is supplied"),
+			FixedArity: 1,
+			NAry:       true,
+			Args:       C(A("x"), A("env")),
+			Examples: E(
+				LE(A("eval"), QL(A("one"), A("two"))),
+				LE(A("eval"), QL(A("+"), N(1), N(2))),
+				LE(A("let"), LE(LE(A("a"), N(1))),
+					LE(A("eval"), QA("a"), LE(A("the-environment")))),
+			),
+			ctl: evalCtl,
+		},
 		"exit": {
 			Name:       "exit",
 			Doc:        DOC("Exit the program"),
@@ -632,6 +858,27 @@ func init() {
 				return nil, nil
 			},
 		},
+		"force": {
+			Name:       "force",
+			Doc:        DOC("Return the value of a delay, evaluating its body if that has not been done yet; return anything else unchanged"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("x")),
+			Examples: E(
+				LE(A("force"), LE(A("delay"), LE(A("+"), N(1), N(2)))),
+				LE(A("force"), N(3)),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("force expects a single argument")
+				}
+				d, ok := args[0].(*delay)
+				if !ok {
+					return args[0], nil
+				}
+				return d.force(e)
+			},
+		},
 		"forms": {
 			Name:       "forms",
 			Doc:        DOC("Return available operators, as a list"),
@@ -680,7 +927,7 @@ func init() {
 					if unicode.IsDigit(firstRune) {
 						return Num(str), nil
 					}
-					return Atom{str}, nil
+					return Intern(str), nil
 				default:
 					return nil, baseError("fuse expects a list")
 				}
@@ -688,7 +935,7 @@ func init() {
 		},
 		"gensym": {
 			Name:       "gensym",
-			Doc:        DOC("Return a new symbol"),
+			Doc:        DOC("Return a new symbol, distinct from all others"),
 			FixedArity: 0,
 			NAry:       true,
 			Args:       RO("more"),
@@ -697,13 +944,13 @@ func init() {
 					return nil, baseError("gensym expects 0 or 1 arguments")
 				}
 				if len(args) == 0 {
-					return Atom{gensym("")}, nil
+					return gensym(""), nil
 				}
 				prefix, ok := args[0].(Atom)
 				if !ok {
 					return nil, baseError("gensym expects an atom as its first argument")
 				}
-				return Atom{gensym("-" + prefix.s)}, nil
+				return gensym("-" + prefix.s), nil
 			},
 		},
 		"help": {
@@ -737,8 +984,48 @@ func init() {
 				if !ok {
 					return nil, baseError("isqrt expects a number")
 				}
-				sqrt := n.bi.Sqrt(&n.bi)
-				return Num(sqrt.String()), nil
+				return bigNum(new(big.Int).Sqrt(n.toBig())), nil
+			},
+		},
+		"join": {
+			Name:       "join",
+			Doc:        DOC("Wait for a task started by spawn to finish, and return its result"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("task")),
+			Examples: E(
+				LE(A("join"), LE(A("spawn"), A("+"), N(1), N(2))),
+				LE(A("map"), A("join"), LE(A("map"), LE(A("lambda"), LE(A("n")), LE(A("spawn"), A("*"), A("n"), A("n"))), LE(A("range"), N(5)))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("join expects a single argument")
+				}
+				t, ok := args[0].(*task)
+				if !ok {
+					return nil, baseErrorf("'%s' is not a task", args[0])
+				}
+				return t.join(threadOf(e).lim)
+			},
+		},
+		"lazy?": {
+			Name:       "lazy?",
+			Doc:        DOC("Return t if the argument is a lazy sequence, () otherwise"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("x")),
+			Examples: E(
+				LE(A("lazy?"), LE(A("range"))),
+				LE(A("lazy?"), LE(A("range"), N(10))),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("lazy? expects a single argument")
+				}
+				if isLazy(args[0]) {
+					return True, nil
+				}
+				return Nil, nil
 			},
 		},
 		"len": {
@@ -750,7 +1037,7 @@ func init() {
 			Examples: E(
 				LE(A("len"), LE(A("range"), N(10))),
 			),
-			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
 				if len(args) != 1 {
 					return nil, baseError("len expects a single argument")
 				}
@@ -761,7 +1048,13 @@ func init() {
 				count := 0
 				for list != nil {
 					count++
-					list = list.cdr.(*ConsCell)
+					tail, err := forceTail(list.cdr, e)
+					if err != nil {
+						return nil, err
+					}
+					if list, ok = tail.(*ConsCell); !ok {
+						return nil, baseErrorf("'%s' is not a list", args[0])
+					}
 				}
 				return Num(count), nil
 			},
@@ -821,6 +1114,22 @@ func init() {
 				return Nil, nil
 			},
 		},
+		"macroexpand": {
+			Name:       "macroexpand",
+			Doc:        DOC("Expand a macro call repeatedly, until the result is not a macro call"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("x")),
+			Examples: E(
+				LE(A("macroexpand"), QL(A("when-not"), A("x"), N(1))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("macroexpand expects a single argument")
+				}
+				return macroexpand(args[0], e)
+			},
+		},
 		"macroexpand-1": {
 			Name:       "macroexpand-1",
 			Doc:        DOC("Expand a macro"),
@@ -838,6 +1147,97 @@ func init() {
 				return macroexpand1(args[0], e)
 			},
 		},
+		"macroexpand-all": {
+			Name:       "macroexpand-all",
+			Doc:        DOC("Expand all macros in an expression, except in quoted forms"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("x")),
+			Examples: E(
+				LE(A("macroexpand-all"), QL(A("when"), A("x"), LE(A("when-not"), A("y"), N(1)))),
+				LE(A("macroexpand-all"), QL(A("list"), QL(A("when"), A("x"), N(1)))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("macroexpand-all expects a single argument")
+				}
+				return macroexpandAll(args[0], e)
+			},
+		},
+		"macroexpand-trace": {
+			Name:       "macroexpand-trace",
+			Doc:        DOC("Return a list of an expression and each successive macro expansion of it"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("x")),
+			Examples: E(
+				LE(A("macroexpand-trace"), QL(A("when-not"), A("x"), N(1))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("macroexpand-trace expects a single argument")
+				}
+				steps, err := macroexpandTrace(args[0], e)
+				if err != nil {
+					return nil, err
+				}
+				return list(steps...), nil
+			},
+		},
+		"make-env": {
+			Name:       "make-env",
+			Doc:        DOC("Make a new, empty environment, inside the given parent environment if one is supplied"),
+			FixedArity: 0,
+			NAry:       true,
+			Args:       RO("parent"),
+			Examples: E(
+				LE(A("make-env")),
+				LE(A("make-env"), LE(A("the-environment"))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				switch len(args) {
+				case 0:
+					env := mkEnv(nil)
+					return &env, nil
+				case 1:
+					parent, ok := args[0].(*Env)
+					if !ok {
+						return nil, baseErrorf("'%s' is not an environment", args[0])
+					}
+					env := mkEnv(parent)
+					return &env, nil
+				}
+				return nil, baseError("make-env expects 0 or 1 arguments")
+			},
+		},
+		"next": {
+			Name:       "next",
+			Doc:        DOC("Resume a generator, returning the next value it yields, or () once it has finished; x, if given, is returned by the yield it was paused at"),
+			FixedArity: 1,
+			NAry:       true,
+			Args:       C(A("g"), A("x")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("g"), LE(A("generator"), LE(A("yield"), N(1)), LE(A("yield"), N(2))))),
+					LE(A("list"), LE(A("next"), A("g")), LE(A("next"), A("g")), LE(A("next"), A("g")))),
+				LE(A("let"), LE(LE(A("g"), LE(A("generator"), LE(A("yield"), LE(A("*"), N(10), LE(A("yield"))))))),
+					LE(A("next"), A("g")),
+					LE(A("next"), A("g"), N(4))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) < 1 || len(args) > 2 {
+					return nil, baseError("next expects a generator and at most one value")
+				}
+				g, ok := args[0].(*generator)
+				if !ok {
+					return nil, baseErrorf("'%s' is not a generator", args[0])
+				}
+				var x Sexpr = Nil
+				if len(args) == 2 {
+					x = args[1]
+				}
+				return g.resume(x, e)
+			},
+		},
 		"not": {
 			Name:       "not",
 			Doc:        DOC("Return t if the argument is nil, () otherwise"),
@@ -881,15 +1281,72 @@ func init() {
 				return Nil, nil
 			},
 		},
+		"pmap": {
+			Name:       "pmap",
+			Doc:        DOC("Apply a function to each element of a list, in parallel, returning the results in order"),
+			FixedArity: 2,
+			NAry:       false,
+			Args:       LC(A("f"), A("xs")),
+			Examples: E(
+				LE(A("pmap"), A("inc"), LE(A("range"), N(10))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 2 {
+					return nil, baseError("pmap expects two arguments")
+				}
+				xs, err := consToExprsIn(args[1], e)
+				if err != nil {
+					return nil, extendError("pmap", err)
+				}
+				ret, err := pmap(args[0], xs, e)
+				if err != nil {
+					return nil, extendError("pmap", err)
+				}
+				return ret, nil
+			},
+		},
+		"preduce": {
+			Name:       "preduce",
+			Doc:        DOC("Like reduce, but reduce runs of the list in parallel, then reduce their results; the function must be associative"),
+			FixedArity: 2,
+			NAry:       true,
+			Args:       C(A("f"), C(A("acc"), A("xs"))),
+			Examples: E(
+				LE(A("preduce"), A("+"), LE(A("range"), N(101))),
+				LE(A("preduce"), A("concat"), QL(), QL(LE(A("a")), LE(A("b")), LE(A("c")))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				var acc Sexpr
+				switch len(args) {
+				case 2:
+				case 3:
+					acc = args[1]
+				default:
+					return nil, baseError("preduce expects two or three arguments")
+				}
+				xs, err := consToExprsIn(args[len(args)-1], e)
+				if err != nil {
+					return nil, extendError("preduce", err)
+				}
+				ret, err := preduce(args[0], acc, xs, e)
+				if err != nil {
+					return nil, extendError("preduce", err)
+				}
+				return ret, nil
+			},
+		},
 		"print": {
 			Name:       "print",
 			Doc:        DOC("Print the arguments"),
 			FixedArity: 0,
 			NAry:       true,
 			Args:       RO("xs"),
-			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
 				strArgs := []string{}
 				for _, arg := range args {
+					if err := forcePrinted(arg, e); err != nil {
+						return nil, err
+					}
 					strArgs = append(strArgs, arg.String())
 				}
 				fmt.Print(strings.Join(strArgs, " "))
@@ -902,9 +1359,12 @@ func init() {
 			FixedArity: 0,
 			NAry:       true,
 			Args:       RO("xs"),
-			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
 				strArgs := []string{}
 				for _, arg := range args {
+					if err := forcePrinted(arg, e); err != nil {
+						return nil, err
+					}
 					strArgs = append(strArgs, arg.String())
 				}
 				fmt.Println(strings.Join(strArgs, " "))
@@ -929,6 +1389,22 @@ func init() {
 				return Nil, nil
 			},
 		},
+		"promise": {
+			Name:       "promise",
+			Doc:        DOC("Make a promise, whose value is supplied later with deliver"),
+			FixedArity: 0,
+			NAry:       false,
+			Args:       Nil,
+			Examples: E(
+				LE(A("promise")),
+			),
+			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+				if len(args) != 0 {
+					return nil, baseError("promise takes no arguments")
+				}
+				return &promise{done: make(chan struct{})}, nil
+			},
+		},
 		"randint": {
 			Name:       "randint",
 			Doc:        DOC("Return a random integer between 0 and the argument minus 1"),
@@ -947,7 +1423,7 @@ func init() {
 					return nil, baseError("randint expects a non-zero argument")
 				}
 				r := rand.New(rand.NewSource(time.Now().UnixNano()))
-				return Num(r.Intn(int(num.bi.Uint64()))), nil
+				return Num(r.Intn(num.int())), nil
 			},
 		},
 		"readlist": {
@@ -968,6 +1444,28 @@ func init() {
 				return mkListAsConsWithCdr(parsed, Nil), nil
 			},
 		},
+		"recv": {
+			Name:       "recv",
+			Doc:        DOC("Receive a value from a channel, waiting until one is sent, or return () if the channel is closed"),
+			FixedArity: 1,
+			NAry:       false,
+			Args:       LC(A("c")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("c"), LE(A("chan")))),
+					LE(A("spawn"), A("send"), A("c"), QA("hello")),
+					LE(A("recv"), A("c"))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 1 {
+					return nil, baseError("recv expects a single argument")
+				}
+				c, err := asChannel(args[0])
+				if err != nil {
+					return nil, err
+				}
+				return c.recv(threadOf(e).lim)
+			},
+		},
 		"screen-start": {
 			Name:       "screen-start",
 			Doc:        DOC("Start screen for text UIs"),
@@ -1038,7 +1536,7 @@ func init() {
 				if err != nil {
 					return nil, extendError("screen-get-key termGetKey", err)
 				}
-				return Atom{key}, nil
+				return Intern(key), nil
 			},
 		},
 		"screen-write": {
@@ -1063,13 +1561,35 @@ func init() {
 				if !ok {
 					return nil, baseErrorf("'%s' is not a list", args[2])
 				}
-				err := termDrawText(int(x.bi.Uint64()), int(y.bi.Uint64()), unwrapList(s))
+				err := termDrawText(x.int(), y.int(), unwrapList(s))
 				if err != nil {
 					return nil, extendError("screen-write termDrawText", err)
 				}
 				return Nil, nil
 			},
 		},
+		"send": {
+			Name:       "send",
+			Doc:        DOC("Send a value on a channel, waiting until it can be received"),
+			FixedArity: 2,
+			NAry:       false,
+			Args:       LC(A("c"), A("x")),
+			Examples: E(
+				LE(A("let"), LE(LE(A("c"), LE(A("chan"), N(1)))),
+					LE(A("send"), A("c"), QA("hello")),
+					LE(A("recv"), A("c"))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) != 2 {
+					return nil, baseError("send expects a channel and a value")
+				}
+				c, err := asChannel(args[0])
+				if err != nil {
+					return nil, err
+				}
+				return Nil, c.send(args[1], threadOf(e).lim)
+			},
+		},
 		"shell": {
 			Name:       "shell",
 			Doc:        DOC("Run a shell subprocess, and return stdout, stderr, and exit code"),
@@ -1089,7 +1609,7 @@ func init() {
 			FixedArity: 1,
 			NAry:       false,
 			Args:       LC(A("xs")),
-			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
 				if len(args) != 1 {
 					return nil, baseError("shuffle expects a single argument")
 				}
@@ -1097,7 +1617,7 @@ func init() {
 				if !ok {
 					return nil, baseErrorf("'%s' is not a list", args[0])
 				}
-				exprs, err := consToExprs(l)
+				exprs, err := consToExprsIn(l, e)
 				if err != nil {
 					return nil, extendError("shuffle consToExprs", err)
 				}
@@ -1121,7 +1641,7 @@ func init() {
 				if !ok {
 					return nil, baseErrorf("'%s' is not a number", args[0])
 				}
-				time.Sleep(time.Duration(num.bi.Uint64()) * time.Millisecond)
+				time.Sleep(time.Duration(num.int()) * time.Millisecond)
 				return Nil, nil
 			},
 		},
@@ -1136,7 +1656,7 @@ func init() {
 				LE(A("sort"), QL()),
 				LE(A("sort"), QL(A("c"), A("b"), A("a"))),
 			),
-			Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
 				if len(args) != 1 {
 					return nil, baseError("sort expects a single argument")
 				}
@@ -1144,7 +1664,7 @@ func init() {
 				if !ok {
 					return nil, baseErrorf("'%s' is not a list", args[0])
 				}
-				exprs, err := consToExprs(l)
+				exprs, err := consToExprsIn(l, e)
 				if err != nil {
 					return nil, extendError("sort consToExprs", err)
 				}
@@ -1190,7 +1710,7 @@ func init() {
 				if !ok {
 					return nil, baseErrorf("'%s' is not a list", args[1])
 				}
-				exprs, err := consToExprs(l)
+				exprs, err := consToExprsIn(l, e)
 				if err != nil {
 					return nil, extendError("sort consToExprs", err)
 				}
@@ -1245,15 +1765,29 @@ func init() {
 				case *Builtin:
 					return nil, baseErrorf("cannot get source of builtin function %s", t)
 				case *lambdaFn:
-					if t.restArg == "" {
-						return Cons(A("lambda"), Cons(t.args, t.body)), nil
-					}
-					return Cons(A("lambda"), Cons(combineArgs(t.args, A(t.restArg)), t.body)), nil
+					return t.source(), nil
 				default:
 					return nil, baseErrorf("'%s' is not a function", args[0])
 				}
 			},
 		},
+		"spawn": {
+			Name:       "spawn",
+			Doc:        DOC("Call a function with the given arguments on a goroutine of its own, returning a task for join"),
+			FixedArity: 1,
+			NAry:       true,
+			Args:       C(A("f"), A("args")),
+			Examples: E(
+				LE(A("spawn"), A("+"), N(1), N(2)),
+				LE(A("join"), LE(A("spawn"), A("+"), N(1), N(2))),
+			),
+			Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+				if len(args) < 1 {
+					return nil, baseError("spawn expects a function")
+				}
+				return spawn(args[0], args[1:], e), nil
+			},
+		},
 		"split": {
 			Name:       "split",
 			Doc:        DOC("Split an atom or number into a list of single-digit numbers or single-character atoms"),
@@ -1278,6 +1812,18 @@ func init() {
 				}
 			},
 		},
+		"the-environment": {
+			Name:       "the-environment",
+			Doc:        DOC("Return the current environment"),
+			FixedArity: 0,
+			NAry:       false,
+			Args:       Nil,
+			Examples: E(
+				LE(A("the-environment")),
+				LE(A("let"), LE(LE(A("a"), N(1))), LE(A("the-environment"))),
+			),
+			ctl: theEnvironmentCtl,
+		},
 		"upcase": {
 			Name:       "upcase",
 			Doc:        DOC("Return the uppercase version of the given atom"),
@@ -1295,7 +1841,7 @@ func init() {
 				if !ok {
 					return nil, baseError("upcase expects an atom")
 				}
-				return Atom{strings.ToUpper(a.s)}, nil
+				return Intern(strings.ToUpper(a.s)), nil
 			},
 		},
 		"version": {
@@ -1312,7 +1858,39 @@ func init() {
 				return mkListAsConsWithCdr(versionSexprs, Nil), nil
 			},
 		},
+		"yield": {
+			Name:       "yield",
+			Doc:        DOC("Pause the running generator, passing x (or ()) to the next call which resumed it"),
+			FixedArity: 0,
+			NAry:       true,
+			Args:       RO("x"),
+			Examples: E(
+				LE(A("next"), LE(A("generator"), LE(A("yield"), QA("hello")))),
+			),
+			ctl: yieldCtl,
+		},
+	}
+	for name, b := range builtins {
+		builtinAtoms[Intern(name)] = b
+	}
+}
+
+// envAndName checks the arguments to the env-* builtins, which take an
+// environment and a symbol (and possibly more).
+func envAndName(fname string, args []Sexpr, n int) (*Env, Atom, error) {
+	if len(args) != n {
+		return nil, Atom{}, baseErrorf("%s expects %d arguments", fname, n)
+	}
+	env, ok := args[0].(*Env)
+	if !ok {
+		return nil, Atom{}, baseErrorf("'%s' is not an environment", args[0])
+	}
+	name, ok := args[1].(Atom)
+	if !ok {
+		return nil, Atom{}, baseErrorf("'%s' is not a symbol", args[1])
 	}
+	// A symbol protected by syntax-quote names the same variable:
+	return env, name.global(), nil
 }
 
 // listOfChars returns a list of single-character atoms from another, presumably
@@ -1322,7 +1900,7 @@ func listOfChars(s string) *ConsCell {
 		return nil
 	}
 	r, size := utf8.DecodeRuneInString(s)
-	return Cons(Atom{string(r)}, listOfChars(s[size:]))
+	return Cons(Intern(string(r)), listOfChars(s[size:]))
 }
 
 // listOfNums returns a list of single-digit numbers from another, presumably
@@ -1361,7 +1939,7 @@ func semverAsExprs(semver string) []Sexpr {
 			continue
 		}
 		if m == "dirty" {
-			list = append(list, Atom{"dirty"})
+			list = append(list, Intern("dirty"))
 		} else {
 			list = append(list, Num(m))
 		}
@@ -0,0 +1,1292 @@
+package lisp
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// macroGen counts changes to macro bindings.  Code compiled under an older
+// generation may contain stale macro expansions.  It is read and changed
+// atomically, as goroutines started by spawn share it.
+var macroGen int64
+
+func macroGeneration() int64 {
+	return atomic.LoadInt64(&macroGen)
+}
+
+// Atoms with special meanings to the compiler:
+var (
+	symQuote         = Intern("quote")
+	symSyntaxQuote   = Intern("syntax-quote")
+	symTest          = Intern("test")
+	symCond          = Intern("cond")
+	symAnd           = Intern("and")
+	symOr            = Intern("or")
+	symLoop          = Intern("loop")
+	symBlock         = Intern("block")
+	symReturnFrom    = Intern("return-from")
+	symSwallow       = Intern("swallow")
+	symDef           = Intern("def")
+	symDefvar        = Intern("defvar")
+	symBinding       = Intern("binding")
+	symSet           = Intern("set!")
+	symDefn          = Intern("defn")
+	symDefmacro      = Intern("defmacro")
+	symDefmulti      = Intern("defmulti")
+	symDefmethod     = Intern("defmethod")
+	symDelay         = Intern("delay")
+	symGenerator     = Intern("generator")
+	symFuture        = Intern("future")
+	symSelect        = Intern("select")
+	symError         = Intern("error")
+	symErrors        = Intern("errors")
+	symTry           = Intern("try")
+	symUnwindProtect = Intern("unwind-protect")
+	symLet           = Intern("let")
+	symLetfn         = Intern("letfn")
+	symLambda        = Intern("lambda")
+	symCatch         = Intern("catch")
+	symFinally       = Intern("finally")
+	symBreak         = Intern("break")
+	symUnquote       = Intern("unquote")
+	symSplicing      = Intern("splicing-unquote")
+)
+
+// specialFormNames are the atoms the compiler handles itself at the head
+// of a form, whatever they are bound to.
+var specialFormNames = map[Atom]bool{}
+
+func init() {
+	for _, a := range []Atom{
+		symQuote, symSyntaxQuote, symTest, symCond, symAnd, symOr, symLoop,
+		symBlock, symReturnFrom, symSwallow, symDef, symDefvar, symBinding,
+		symSet, symDefn, symDefmacro, symDefsyntax, symDefmulti,
+		symDefmethod, symDelay, symGenerator, symFuture, symSelect,
+		symError, symErrors, symTry, symUnwindProtect, symLet, symLetfn,
+		symLambda,
+	} {
+		specialFormNames[a] = true
+	}
+}
+
+// scope tracks the names bound lexically around the code being compiled.
+// Each scope corresponds to one local Env at run time, with the names in
+// the same order as the Env's slots.
+type scope struct {
+	names  []Atom
+	parent *scope
+}
+
+// resolve finds the lexical address of a name: how many environments up it
+// is bound, and at which slot.
+func (s *scope) resolve(name Atom) (depth, slot int, ok bool) {
+	for ; s != nil; s = s.parent {
+		for i := len(s.names) - 1; i >= 0; i-- {
+			if s.names[i] == name {
+				return depth, i, true
+			}
+		}
+		depth++
+	}
+	return 0, 0, false
+}
+
+func (s *scope) binds(name Atom) bool {
+	_, _, ok := s.resolve(name)
+	return ok
+}
+
+// add adds a name to the scope, returning its slot.
+func (s *scope) add(name Atom) int {
+	s.names = append(s.names, name)
+	return len(s.names) - 1
+}
+
+// compiler turns S-expressions into code for the VM.  Macros are expanded
+// as they are encountered, using the definitions visible from env.
+type compiler struct {
+	code  *code
+	env   *Env
+	scope *scope
+	// Whether the outermost scope sits directly in the top-level
+	// environment, so that any name not in scope must be global:
+	rooted bool
+}
+
+// compile compiles a single expression for evaluation in e.  Malformed
+// expressions are not reported here; they compile to code which raises the
+// error when (and if) it is reached, just as if the expression were being
+// interpreted.
+func compile(x Sexpr, e *Env) *code {
+	return compileScoped(x, e, nil, e.parent == nil)
+}
+
+// compileScoped compiles an expression appearing at a known point in
+// already-compiled code, whose environment e corresponds to scope s.
+func compileScoped(x Sexpr, e *Env, s *scope, rooted bool) *code {
+	c := compiler{
+		code:   &code{gen: macroGeneration(), scope: s, rooted: rooted},
+		env:    e,
+		scope:  s,
+		rooted: rooted,
+	}
+	c.expr(x, true)
+	c.emit(opReturn, 0)
+	return c.code
+}
+
+func (c *compiler) emit(op opcode, arg int) int {
+	c.code.instrs = append(c.code.instrs, instr{op, arg})
+	return len(c.code.instrs) - 1
+}
+
+// here returns the address of the next instruction to be emitted.
+func (c *compiler) here() int {
+	return len(c.code.instrs)
+}
+
+// patch points the jump at addr to the next instruction to be emitted.
+func (c *compiler) patch(addr int) {
+	c.code.instrs[addr].arg = c.here()
+}
+
+func (c *compiler) constant(x Sexpr) int {
+	c.code.consts = append(c.code.consts, x)
+	return len(c.code.consts) - 1
+}
+
+// expr compiles x, leaving its value on the stack.  If x is in tail
+// position, function calls reuse the current frame.
+func (c *compiler) expr(x Sexpr, tail bool) {
+	start := c.here()
+	spans := len(c.code.forms)
+	if err := c.form(x, tail); err != nil {
+		c.code.instrs = c.code.instrs[:start]
+		c.code.forms = c.code.forms[:spans]
+		c.emit(opFail, c.constant(errorList(err)))
+	}
+}
+
+// body compiles a sequence of expressions, leaving the value of the last
+// one (or () if there are none) on the stack.
+func (c *compiler) body(xs []Sexpr, tail bool) {
+	if len(xs) == 0 {
+		c.emit(opNil, 0)
+		return
+	}
+	for i, x := range xs {
+		last := i == len(xs)-1
+		c.expr(x, tail && last)
+		if !last {
+			c.emit(opPop, 0)
+		}
+	}
+}
+
+func (c *compiler) isMacroCall(x *ConsCell) bool {
+	if car, ok := x.car.(Atom); ok && c.scope.binds(car) {
+		return false
+	}
+	return isMacroCall(x, c.env)
+}
+
+func (c *compiler) form(x Sexpr, tail bool) error {
+	switch t := x.(type) {
+	case Atom:
+		switch {
+		case t == True:
+			c.emit(opTrue, 0)
+		case isKeyword(t):
+			c.emit(opConst, c.constant(t))
+		case isCxr(t):
+			c.emit(opLambda, c.constant(c.lambdaCode(extractCxrLambda(t))))
+		default:
+			c.lookup(t)
+		}
+		return nil
+	case Number:
+		c.emit(opConst, c.constant(t))
+		return nil
+	case *ConsCell:
+		if t == Nil {
+			c.emit(opNil, 0)
+			return nil
+		}
+		if c.isMacroCall(t) {
+			return c.macroCall(t, tail)
+		}
+		cdrCons, ok := t.cdr.(*ConsCell)
+		if !ok {
+			return baseError("malformed list for eval")
+		}
+		// special forms, which may be protected (see syntaxQuote):
+		if carAtom, ok := t.car.(Atom); ok {
+			switch carAtom.global() {
+			case symQuote:
+				if cdrCons == Nil {
+					return baseError("quote needs an argument")
+				}
+				c.emit(opConst, c.constant(cdrCons.car))
+				return nil
+			case symSyntaxQuote:
+				if cdrCons == Nil {
+					return baseError("syntax-quote needs an argument")
+				}
+				code, err := syntaxQuote(cdrCons.car, c.env)
+				if err != nil {
+					return extendError("syntax-quote", err)
+				}
+				return c.form(code, tail)
+			case symTest:
+				return c.test(cdrCons)
+			case symCond:
+				return c.cond(cdrCons, tail)
+			case symAnd:
+				return c.and(cdrCons, tail)
+			case symOr:
+				return c.or(cdrCons, tail)
+			case symLoop:
+				return c.loop(cdrCons)
+			case symBlock:
+				return c.block(cdrCons)
+			case symReturnFrom:
+				return c.returnFrom(cdrCons)
+			case symSwallow:
+				return c.swallow(cdrCons)
+			case symDef:
+				return c.def("def", cdrCons, opDef)
+			case symDefvar:
+				return c.def("defvar", cdrCons, opDefvar)
+			case symBinding:
+				return c.binding(cdrCons)
+			case symSet:
+				return c.set(cdrCons)
+			case symDefn:
+				return c.defn(cdrCons, false)
+			case symDefmacro:
+				return c.defn(cdrCons, true)
+			case symDefsyntax:
+				return c.defsyntax(cdrCons)
+			case symDefmulti:
+				return c.defmulti(cdrCons)
+			case symDefmethod:
+				return c.defmethod(cdrCons, tail)
+			case symDelay:
+				fn := Cons(symLambda, Cons(Nil, cdrCons))
+				return c.form(list(list(symQuote, mkDelay), fn), tail)
+			case symGenerator:
+				fn := Cons(symLambda, Cons(Nil, cdrCons))
+				return c.form(list(list(symQuote, mkGenerator), fn), tail)
+			case symFuture:
+				fn := Cons(symLambda, Cons(Nil, cdrCons))
+				return c.form(list(list(symQuote, mkFuture), fn), tail)
+			case symSelect:
+				return c.selectForm(cdrCons, tail)
+			case symError:
+				if cdrCons == Nil {
+					return baseError("error requires a non-empty argument list")
+				}
+				c.expr(cdrCons.car, false)
+				c.emit(opRaise, 0)
+				return nil
+			case symErrors:
+				return c.errors(cdrCons)
+			case symTry:
+				return c.try(cdrCons, tail)
+			case symUnwindProtect:
+				return c.unwindProtect(cdrCons)
+			case symLet:
+				return c.let(cdrCons, tail)
+			case symLetfn:
+				return c.letfn(cdrCons, tail)
+			case symLambda:
+				fn, err := mkLambda(cdrCons, false)
+				if err != nil {
+					return err
+				}
+				c.emit(opLambda, c.constant(c.lambdaCode(fn)))
+				return nil
+			}
+		}
+		return c.call(t, cdrCons, tail)
+	default:
+		return baseErrorf("unknown expression type: %q", t)
+	}
+}
+
+// lookup compiles a reference to a variable.  A protected atom not bound
+// as such refers to the global it stands for, whatever is in scope.
+func (c *compiler) lookup(a Atom) {
+	if depth, slot, ok := c.scope.resolve(a); ok {
+		c.emit(opLocal, c.ref(a, depth, slot))
+	} else if c.rooted || a.global() != a {
+		c.emit(opGlobal, c.constant(a.global()))
+	} else {
+		c.emit(opLookup, c.constant(a))
+	}
+}
+
+func (c *compiler) ref(name Atom, depth, slot int) int {
+	c.code.refs = append(c.code.refs, varRef{name, depth, slot})
+	return len(c.code.refs) - 1
+}
+
+// macroCall expands a macro call in place, guarded by a check that the
+// macro is unchanged when the code runs.
+func (c *compiler) macroCall(form *ConsCell, tail bool) error {
+	name := form.car.(Atom)
+	fn, _ := lookupHead(name, c.env)
+	mu := len(c.code.macros)
+	c.code.macros = append(c.code.macros, macroUse{
+		name:  name,
+		fn:    fn.(*lambdaFn),
+		form:  form,
+		tail:  tail,
+		scope: c.scope,
+	})
+	c.emit(opMacroCheck, mu)
+	// Errors during expansion only matter if the macro is unchanged:
+	if expanded, err := macroexpand1(form, c.env); err != nil {
+		c.emit(opFail, c.constant(errorList(extendError("eval macroexpansion", err))))
+	} else {
+		c.expr(expanded, tail)
+	}
+	c.code.macros[mu].next = c.here()
+	return nil
+}
+
+// call compiles normal function application: the function, then its
+// arguments, are evaluated in order.
+func (c *compiler) call(form, args *ConsCell, tail bool) error {
+	argExprs, err := consToExprs(args)
+	if err != nil {
+		return err
+	}
+	c.expr(form.car, false)
+	cs := len(c.code.calls)
+	c.code.calls = append(c.code.calls, callSite{
+		nargs: len(argExprs),
+		form:  form,
+		tail:  tail,
+		scope: c.scope,
+	})
+	// A global function might be redefined as a macro before this code runs:
+	if car, ok := form.car.(Atom); ok && !c.scope.binds(car) {
+		c.emit(opMacroGuard, cs)
+	}
+	for _, arg := range argExprs {
+		c.expr(arg, false)
+	}
+	if tail {
+		c.emit(opTailCall, cs)
+	} else {
+		c.emit(opCall, cs)
+	}
+	c.code.calls[cs].next = c.here()
+	return nil
+}
+
+// lambdaCode compiles the body of a lambda template, in a new scope
+// containing the lambda's arguments.
+func (c *compiler) lambdaCode(fn *lambdaFn) *lambdaFn {
+	outer := c.scope
+	if fn.name != noName {
+		// A named lambda sees its own name, in an environment of its own
+		// (see closure()):
+		outer = &scope{names: []Atom{fn.name}, parent: outer}
+	}
+	fn.code = compileLambda(fn, c.env, outer, c.rooted)
+	return fn
+}
+
+// compileLambda compiles the body of fn, which appears in the scope outer.
+// The lambda's arguments occupy the first slots of its scope (see
+// lambdaFn.slotNames).  A lambda with several arities has each compiled
+// separately.
+func compileLambda(fn *lambdaFn, e *Env, outer *scope, rooted bool) *code {
+	if fn.arities != nil {
+		c := &code{gen: macroGeneration(), scope: &scope{parent: outer}, rooted: rooted}
+		for _, arity := range fn.arities {
+			c.arities = append(c.arities, compileLambda(arity, e, outer, rooted))
+		}
+		return c
+	}
+	names := fn.slotNames()
+	s := &scope{names: names, parent: outer}
+	inner := compiler{
+		code:   &code{gen: macroGeneration(), scope: s, rooted: rooted},
+		env:    e,
+		scope:  s,
+		rooted: rooted,
+	}
+	xs, err := consToExprs(fn.body)
+	if bindsT(names) {
+		inner.emit(opFail, inner.constant(errorList(
+			extendError("lambda env setup", baseError("cannot bind or set t")))))
+	} else if err != nil {
+		inner.emit(opFail, inner.constant(errorList(err)))
+	} else {
+		// Errors setting up the arguments show the argument list:
+		inner.code.forms = append(inner.code.forms, formSpan{inner.here(), fn.params()})
+		inner.destructureArgs(fn)
+		inner.defaults(fn, outer)
+		if len(xs) == 0 {
+			inner.emit(opNil, 0)
+		}
+	}
+	for i, x := range xs {
+		inner.code.forms = append(inner.code.forms, formSpan{inner.here(), x})
+		last := i == len(xs)-1
+		inner.expr(x, last)
+		if !last {
+			inner.emit(opPop, 0)
+		}
+	}
+	inner.emit(opReturn, 0)
+	return inner.code
+}
+
+// destructureArgs compiles code to bind the names in any patterns among
+// a lambda's required arguments.
+func (c *compiler) destructureArgs(fn *lambdaFn) {
+	names := c.scope.names
+	next := len(names)
+	for _, p := range fn.patterns {
+		next -= len(p.names)
+	}
+	for _, p := range fn.patterns {
+		for slot, name := range names {
+			if name == p.hidden {
+				c.emit(opLocal, c.ref(name, 0, slot))
+				break
+			}
+		}
+		c.emit(opDestructure, c.constant(p.pattern))
+		for i := len(p.names) - 1; i >= 0; i-- {
+			c.emit(opSetLocal, c.ref(p.names[i], 0, next+i))
+			c.emit(opPop, 0)
+		}
+		next += len(p.names)
+	}
+}
+
+// defaults compiles code to fill in the values of any &optional and &key
+// arguments not supplied by the caller.  Each default may refer to the
+// other arguments, except for the &optional and &key arguments after it.
+func (c *compiler) defaults(fn *lambdaFn, outer *scope) {
+	n, _ := consLength(fn.args)
+	saved := c.scope
+	params := append(append([]param{}, fn.optionals...), fn.keys...)
+	for i, p := range params {
+		slot := n + i
+		c.emit(opUnsupplied, slot)
+		j := c.emit(opJumpIfNil, 0)
+		// Hide this argument and those after it:
+		names := append([]Atom{}, saved.names...)
+		for k := slot; k < n+len(params); k++ {
+			names[k] = noName
+		}
+		c.scope = &scope{names: names, parent: outer}
+		if p.dflt == nil {
+			c.emit(opNil, 0)
+		} else {
+			c.expr(p.dflt, false)
+		}
+		c.scope = saved
+		c.emit(opSetLocal, c.ref(p.name, 0, slot))
+		c.emit(opPop, 0)
+		c.patch(j)
+	}
+}
+
+func (c *compiler) test(body *ConsCell) error {
+	if body == Nil {
+		c.emit(opNil, 0)
+		return nil
+	}
+	exprs, err := consToExprs(body.cdr)
+	if err != nil {
+		return baseError("test body must be a list")
+	}
+	c.expr(body.car, false)
+	c.emit(opTestBegin, 0)
+	for _, x := range exprs {
+		c.expr(x, false)
+		c.emit(opPop, 0)
+		c.emit(opTestStep, 0)
+	}
+	c.emit(opTestEnd, 0)
+	c.emit(opNil, 0)
+	return nil
+}
+
+func (c *compiler) cond(pairList *ConsCell, tail bool) error {
+	ends := []int{}
+	for pairList != Nil {
+		pair, ok := pairList.car.(*ConsCell)
+		if !ok || pair == Nil {
+			c.emit(opFail, c.constant(errorList(baseError("cond requires a list of pairs"))))
+			break
+		}
+		c.expr(pair.car, false)
+		next := c.emit(opJumpIfNil, 0)
+		cdrCons, ok := pair.cdr.(*ConsCell)
+		if !ok || cdrCons == Nil {
+			c.emit(opFail, c.constant(errorList(baseError("cond requires a list of pairs"))))
+		} else {
+			c.expr(cdrCons.car, tail)
+			ends = append(ends, c.emit(opJump, 0))
+		}
+		c.patch(next)
+		pairList, ok = pairList.cdr.(*ConsCell)
+		if !ok {
+			return baseError("cond requires a list of pairs")
+		}
+	}
+	c.emit(opNil, 0)
+	for _, end := range ends {
+		c.patch(end)
+	}
+	return nil
+}
+
+// and returns () at the first expression which is (), or else the value of
+// the last one, which is in tail position.
+func (c *compiler) and(xs *ConsCell, tail bool) error {
+	exprs, err := consToExprs(xs)
+	if err != nil {
+		return baseError("and requires a list of expressions")
+	}
+	if len(exprs) == 0 {
+		c.emit(opTrue, 0)
+		return nil
+	}
+	fails := []int{}
+	for _, x := range exprs[:len(exprs)-1] {
+		c.expr(x, false)
+		fails = append(fails, c.emit(opJumpIfNil, 0))
+	}
+	c.expr(exprs[len(exprs)-1], tail)
+	end := c.emit(opJump, 0)
+	for _, f := range fails {
+		c.patch(f)
+	}
+	c.emit(opNil, 0)
+	c.patch(end)
+	return nil
+}
+
+// or returns the value of the first expression which isn't (), the last
+// expression being in tail position.
+func (c *compiler) or(xs *ConsCell, tail bool) error {
+	exprs, err := consToExprs(xs)
+	if err != nil {
+		return baseError("or requires a list of expressions")
+	}
+	if len(exprs) == 0 {
+		c.emit(opNil, 0)
+		return nil
+	}
+	ends := []int{}
+	for _, x := range exprs[:len(exprs)-1] {
+		c.expr(x, false)
+		ends = append(ends, c.emit(opJumpIfTrue, 0))
+	}
+	c.expr(exprs[len(exprs)-1], tail)
+	for _, end := range ends {
+		c.patch(end)
+	}
+	return nil
+}
+
+func (c *compiler) loop(body *ConsCell) error {
+	exprs, err := consToExprs(body)
+	if err != nil {
+		return err
+	}
+	// Loops can be exited with `break`:
+	b := c.pushBlock(symBreak)
+	top := c.here()
+	for _, x := range exprs {
+		c.expr(x, false)
+		c.emit(opPop, 0)
+	}
+	c.emit(opJump, top)
+	c.code.blocks[b].end = c.here()
+	return nil
+}
+
+// pushBlock emits the start of a named block, returning its index in the
+// code's blocks.
+func (c *compiler) pushBlock(name Atom) int {
+	b := len(c.code.blocks)
+	c.code.blocks = append(c.code.blocks, blockInfo{name: name})
+	c.emit(opBlock, b)
+	return b
+}
+
+// block compiles a named block, which can be exited early with
+// `return-from`.  Block names aren't variables, so a protected name (see
+// syntaxQuote) is the same as the original.
+func (c *compiler) block(args *ConsCell) error {
+	if args == Nil {
+		return baseError("block requires a name")
+	}
+	name, ok := args.car.(Atom)
+	if !ok {
+		return baseError("block name must be an atom")
+	}
+	exprs, err := consToExprs(args.cdr)
+	if err != nil {
+		return baseError("block body must be a list")
+	}
+	b := c.pushBlock(name.global())
+	c.body(exprs, false)
+	c.emit(opPopHandler, 0)
+	c.code.blocks[b].end = c.here()
+	return nil
+}
+
+func (c *compiler) returnFrom(args *ConsCell) error {
+	if args == Nil {
+		return baseError("return-from requires a block name")
+	}
+	name, ok := args.car.(Atom)
+	if !ok {
+		return baseError("block name must be an atom")
+	}
+	exprs, err := consToExprs(args.cdr)
+	if err != nil || len(exprs) > 1 {
+		return baseError("return-from takes a block name and at most one value")
+	}
+	c.body(exprs, false)
+	c.emit(opReturnFrom, c.constant(name.global()))
+	return nil
+}
+
+func (c *compiler) swallow(body *ConsCell) error {
+	exprs, err := consToExprs(body)
+	if err != nil {
+		return err
+	}
+	h := c.emit(opPushHandler, 0)
+	for _, x := range exprs {
+		c.expr(x, false)
+		c.emit(opPop, 0)
+	}
+	c.emit(opPopHandler, 0)
+	c.emit(opNil, 0)
+	end := c.emit(opJump, 0)
+	c.patch(h)
+	c.emit(opPop, 0)
+	c.emit(opTrue, 0)
+	c.patch(end)
+	return nil
+}
+
+// def compiles `def` or `defvar`, which differ only in the instruction
+// which binds the name.
+func (c *compiler) def(form string, args *ConsCell, op opcode) error {
+	if args == Nil {
+		return baseError("missing argument")
+	}
+	carAtom, ok := args.car.(Atom)
+	if !ok {
+		return baseErrorf("%s: first argument must be an atom", form)
+	}
+	args, ok = args.cdr.(*ConsCell)
+	if !ok || args == Nil {
+		return baseError("missing argument")
+	}
+	c.expr(args.car, false)
+	c.emit(op, c.constant(carAtom.global()))
+	return nil
+}
+
+func (c *compiler) set(args *ConsCell) error {
+	if args == Nil {
+		return baseError("missing argument")
+	}
+	if args.car == Nil {
+		return baseError("set!: first argument cannot be nil!")
+	}
+	carAtom, ok := args.car.(Atom)
+	if !ok {
+		return baseErrorf("set!: first argument must be an atom")
+	}
+	args, ok = args.cdr.(*ConsCell)
+	if !ok || args == Nil {
+		return baseError("missing argument")
+	}
+	c.expr(args.car, false)
+	if depth, slot, ok := c.scope.resolve(carAtom); ok {
+		c.emit(opSetLocal, c.ref(carAtom, depth, slot))
+	} else {
+		c.emit(opSet, c.constant(carAtom.global()))
+	}
+	return nil
+}
+
+func (c *compiler) defn(args *ConsCell, isMacro bool) error {
+	errPreamble := "defn"
+	if isMacro {
+		errPreamble = "defmacro"
+	}
+	if args == Nil {
+		return baseErrorf("%s requires a function name", errPreamble)
+	}
+	name, ok := args.car.(Atom)
+	if !ok {
+		return baseErrorf("%s name must be an atom", errPreamble)
+	}
+	args, ok = args.cdr.(*ConsCell)
+	if !ok || args == Nil {
+		return baseErrorf("%s requires an argument list", errPreamble)
+	}
+	fn, err := mkLambda(args, isMacro)
+	if err != nil {
+		return extendError("creating lambda function", err)
+	}
+	c.emit(opLambda, c.constant(c.lambdaCode(fn)))
+	c.emit(opDefn, c.constant(name.global()))
+	return nil
+}
+
+// defmulti defines a multimethod (see multi.go), given its name, an
+// optional doc form, and a dispatch function.
+func (c *compiler) defmulti(args *ConsCell) error {
+	forms, err := consToExprs(args)
+	if err != nil || len(forms) == 0 {
+		return baseError("defmulti requires a name")
+	}
+	name, ok := forms[0].(Atom)
+	if !ok {
+		return baseError("defmulti name must be an atom")
+	}
+	doc := Nil
+	if len(forms) == 3 {
+		d, ok := forms[1].(*ConsCell)
+		if !ok || !listStartsWith(d, symDoc) {
+			return baseError("defmulti expects a doc form before the dispatch function")
+		}
+		doc = d.cdr.(*ConsCell)
+	} else if len(forms) != 2 {
+		return baseError("defmulti requires a name and a dispatch function")
+	}
+	err = c.form(list(list(symQuote, mkMultiFn), list(symQuote, name), list(symQuote, doc), forms[len(forms)-1]), false)
+	if err != nil {
+		return err
+	}
+	c.emit(opDefn, c.constant(name.global()))
+	return nil
+}
+
+// defmethod adds a method to a multimethod, for a dispatch value.
+func (c *compiler) defmethod(args *ConsCell, tail bool) error {
+	forms, err := consToExprs(args)
+	if err != nil || len(forms) < 3 {
+		return baseError("defmethod requires a multimethod, a dispatch value and an argument list")
+	}
+	fn := Cons(symLambda, args.cdr.(*ConsCell).cdr)
+	return c.form(list(list(symQuote, addMethodFn), forms[0], forms[1], fn), tail)
+}
+
+// selectForm compiles a select form to a call of selectFn, passing the
+// kind, channel and value to send of each clause, and a function of its
+// body; the clause for a receive binds the value received.
+func (c *compiler) selectForm(args *ConsCell, tail bool) error {
+	clauses, err := consToExprs(args)
+	if err != nil {
+		return err
+	}
+	if len(clauses) == 0 {
+		return baseError("select requires at least one clause")
+	}
+	call := []Sexpr{list(symQuote, selectFn)}
+	defaults := 0
+	for _, x := range clauses {
+		clause, ok := x.(*ConsCell)
+		if !ok || clause == Nil {
+			return baseErrorf("select clause %s is not a list", x)
+		}
+		parts, err := consToExprs(clause)
+		if err != nil {
+			return err
+		}
+		switch {
+		case listStartsWith(clause, symRecv):
+			if len(parts) < 3 {
+				return baseError("select recv clause requires a channel and a name")
+			}
+			name, ok := parts[2].(Atom)
+			if !ok {
+				return baseErrorf("select recv clause name '%s' is not an atom", parts[2])
+			}
+			fn := Cons(symLambda, Cons(list(name), list(parts[3:]...)))
+			call = append(call, list(symQuote, symRecv), parts[1], Nil, fn)
+		case listStartsWith(clause, symSend):
+			if len(parts) < 3 {
+				return baseError("select send clause requires a channel and a value")
+			}
+			fn := Cons(symLambda, Cons(Nil, list(parts[3:]...)))
+			call = append(call, list(symQuote, symSend), parts[1], parts[2], fn)
+		case listStartsWith(clause, symDefault):
+			if defaults++; defaults > 1 {
+				return baseError("select allows only one default clause")
+			}
+			fn := Cons(symLambda, Cons(Nil, list(parts[1:]...)))
+			call = append(call, list(symQuote, symDefault), Nil, Nil, fn)
+		default:
+			return baseErrorf("select clause %s must start with recv, send or default", clause)
+		}
+	}
+	return c.form(list(call...), tail)
+}
+
+// defsyntax defines a macro by pattern-matching rules (see syntax.go).
+// The macro is an ordinary one, whose body hands the call's arguments to
+// the rules.
+func (c *compiler) defsyntax(args *ConsCell) error {
+	if args == Nil {
+		return baseError("defsyntax requires a name")
+	}
+	name, ok := args.car.(Atom)
+	if !ok {
+		return baseError("defsyntax name must be an atom")
+	}
+	forms, err := consToExprs(args.cdr)
+	if err != nil {
+		return err
+	}
+	doc := []Sexpr{}
+	if len(forms) > 0 {
+		if d, ok := forms[0].(*ConsCell); ok && listStartsWith(d, symDoc) {
+			doc, forms = forms[:1], forms[1:]
+		}
+	}
+	if len(forms) == 0 {
+		return baseError("defsyntax requires a list of literals")
+	}
+	rules, err := mkSyntaxRules(name, forms[0], forms[1:])
+	if err != nil {
+		return extendError("defsyntax", err)
+	}
+	expander := &Builtin{
+		Name:       "syntax-rules",
+		Fn:         rules.expand,
+		FixedArity: 1,
+	}
+	form := Intern("form")
+	body := append(doc, list(list(symQuote, expander), form))
+	fn, err := mkLambda(Cons(Cons(Nil, form), list(body...)), true)
+	if err != nil {
+		return extendError("defsyntax", err)
+	}
+	c.emit(opLambda, c.constant(c.lambdaCode(fn)))
+	c.emit(opDefn, c.constant(name.global()))
+	return nil
+}
+
+func (c *compiler) errors(args *ConsCell) error {
+	if args == Nil {
+		return baseError("no error spec given")
+	}
+	sigExpr, ok := args.car.(*ConsCell)
+	if !ok {
+		return baseError("error signature must be a list")
+	}
+	exprs, err := consToExprs(args.cdr)
+	if err != nil {
+		return err
+	}
+	c.expr(sigExpr, false)
+	c.emit(opErrorsSig, 0)
+	h := c.emit(opPushHandler, 0)
+	for _, x := range exprs {
+		c.expr(x, false)
+		c.emit(opPop, 0)
+	}
+	c.emit(opPopHandler, 0)
+	c.emit(opFail, c.constant(errorList(baseErrorf("error not found in %s", args))))
+	c.patch(h)
+	c.emit(opErrorsMatch, 0)
+	return nil
+}
+
+// try evaluates its body, keeping the value of the last expression to
+// succeed.  If an error occurs and a `catch` clause is present, the clause's
+// body is evaluated with the error bound to the given name.  The body of a
+// `finally` clause, if any, is evaluated however the `try` is left.
+//
+// Without either clause, errors pass straight through, so the body is
+// compiled like that of `progn`, with its last expression in tail position.
+func (c *compiler) try(args *ConsCell, tail bool) error {
+	var exprs []Sexpr
+	var catch, finally *ConsCell
+	for ; args != Nil; args = args.cdr.(*ConsCell) {
+		if clause, ok := args.car.(*ConsCell); ok && listStartsWith(clause, symCatch) {
+			catch = clause
+			if rest, ok := args.cdr.(*ConsCell); ok && rest != Nil {
+				if clause, ok := rest.car.(*ConsCell); ok && listStartsWith(clause, symFinally) {
+					finally = clause
+				}
+			}
+			break
+		}
+		if clause, ok := args.car.(*ConsCell); ok && listStartsWith(clause, symFinally) {
+			finally = clause
+			break
+		}
+		exprs = append(exprs, args.car)
+		if _, ok := args.cdr.(*ConsCell); !ok {
+			return baseError("try requires a list of expressions")
+		}
+	}
+	if catch == nil && finally == nil {
+		c.body(exprs, tail)
+		return nil
+	}
+	if finally == nil {
+		c.tryCatch(exprs, catch, tail)
+		return nil
+	}
+	cleanup, err := consToExprs(finally.cdr)
+	if err != nil {
+		return baseError("finally requires a list of expressions")
+	}
+	c.protect(func() { c.tryCatch(exprs, catch, false) },
+		func() { c.effects(cleanup) })
+	return nil
+}
+
+// tryCatch compiles the body of a try and its catch clause.  The catch
+// clause runs after its handler is discarded, so can make tail calls.
+func (c *compiler) tryCatch(exprs []Sexpr, catch *ConsCell, tail bool) {
+	c.emit(opNil, 0)
+	h := c.emit(opPushHandler, 0)
+	for _, x := range exprs {
+		c.expr(x, false)
+		c.emit(opSetTop, 0)
+	}
+	c.emit(opPopHandler, 0)
+	end := c.emit(opJump, 0)
+	c.patch(h)
+	if catch == nil {
+		c.emit(opRethrow, 0)
+	} else {
+		c.catch(catch, tail)
+	}
+	c.patch(end)
+}
+
+// unwindProtect evaluates its first argument, then its cleanup forms,
+// whether the first argument returned normally or not.
+func (c *compiler) unwindProtect(args *ConsCell) error {
+	if args == Nil {
+		return baseError("unwind-protect requires a protected form")
+	}
+	cleanup, err := consToExprs(args.cdr)
+	if err != nil {
+		return baseError("unwind-protect cleanup must be a list of expressions")
+	}
+	c.protect(func() { c.expr(args.car, false) }, func() { c.effects(cleanup) })
+	return nil
+}
+
+// protect compiles body so that the cleanup code runs after it on every
+// exit: normal returns, errors, `return-from` and continuations.  The
+// cleanup code runs with an unwinding on top of the stack saying how to
+// carry on afterwards, and must leave the stack as it found it.
+func (c *compiler) protect(body func(), cleanup func()) {
+	h := c.emit(opPushCleanup, 0)
+	body()
+	c.emit(opPopHandler, 0)
+	c.emit(opConst, c.constant(normalExit))
+	c.patch(h)
+	cleanup()
+	c.emit(opEndCleanup, 0)
+}
+
+// effects compiles expressions for their side effects only.
+func (c *compiler) effects(xs []Sexpr) {
+	for _, x := range xs {
+		c.expr(x, false)
+		c.emit(opPop, 0)
+	}
+}
+
+// binding compiles (binding ((name value) ...) body...), which gives
+// special variables (see `defvar`) new values for the duration of the
+// body, on the thread running it (see vm.bind).  The bindings are undone
+// on the way out, however the body is exited.
+func (c *compiler) binding(args *ConsCell) error {
+	if args == Nil {
+		return baseError("binding requires a binding list")
+	}
+	bindings, ok := args.car.(*ConsCell)
+	if !ok {
+		return baseError("binding bindings must be a list")
+	}
+	exprs, err := consToExprs(args.cdr)
+	if err != nil {
+		return baseError("binding requires a body")
+	}
+	names := []Sexpr{}
+	for ; bindings != Nil; bindings = bindings.cdr.(*ConsCell) {
+		binding, ok := bindings.car.(*ConsCell)
+		if !ok || binding == Nil {
+			return baseError("a binding must be a list of binding pairs")
+		}
+		name, ok := binding.car.(Atom)
+		if !ok {
+			return baseError("a binding must be a list of binding pairs")
+		}
+		rest, ok := binding.cdr.(*ConsCell)
+		if !ok || rest == Nil || rest.cdr != Nil {
+			return baseError("a binding must be a list of binding pairs")
+		}
+		c.expr(rest.car, false)
+		names = append(names, name.global())
+		if _, ok := bindings.cdr.(*ConsCell); !ok {
+			return baseError("binding bindings must be a list")
+		}
+	}
+	nameList := c.constant(mkListAsConsWithCdr(names, Nil))
+	c.emit(opBind, nameList)
+	c.protect(func() { c.body(exprs, false) }, func() {
+		c.emit(opUnbind, nameList)
+	})
+	return nil
+}
+
+// catch compiles a catch clause, which runs with the caught error on top of
+// the stack and the value of the try body underneath it.
+func (c *compiler) catch(clause *ConsCell, tail bool) {
+	fail := func(msg string) {
+		c.emit(opFail, c.constant(errorList(baseError(msg))))
+	}
+	cdr, ok := clause.cdr.(*ConsCell)
+	if !ok || cdr == Nil {
+		fail("catch body must be a list with a binding name")
+		return
+	}
+	sym, ok := cdr.car.(Atom)
+	if !ok {
+		fail("catch binding name must be a symbol")
+		return
+	}
+	exprs, err := consToExprs(cdr.cdr)
+	if err != nil {
+		fail("catch body must be a list with a binding name")
+		return
+	}
+	saved := c.scope
+	c.scope = &scope{names: []Atom{sym}, parent: saved}
+	c.code.lets = append(c.code.lets, letInfo{1, c.scope})
+	c.emit(opLet, len(c.code.lets)-1)
+	if len(exprs) > 0 {
+		c.emit(opPop, 0)
+		c.body(exprs, tail)
+	}
+	c.scope = saved
+	c.emit(opPopEnv, 0)
+}
+
+func (c *compiler) let(args *ConsCell, tail bool) error {
+	if args == Nil {
+		return baseError("let requires a binding list")
+	}
+	bindings, ok := args.car.(*ConsCell)
+	if !ok {
+		return baseError("let bindings must be a list")
+	}
+	body, ok := args.cdr.(*ConsCell)
+	if !ok {
+		return baseError("let requires a body")
+	}
+	exprs, err := consToExprs(body)
+	if err != nil {
+		return err
+	}
+	names := []Atom{}
+	for ; bindings != Nil; bindings = bindings.cdr.(*ConsCell) {
+		binding, ok := bindings.car.(*ConsCell)
+		if !ok || binding == Nil {
+			return baseError("a let binding must be a list of binding pairs")
+		}
+		bound, err := bindingNames(binding.car)
+		if err != nil {
+			return err
+		}
+		asCons, ok := binding.cdr.(*ConsCell)
+		if !ok {
+			return baseError("a let binding must be a list of binding pairs")
+		}
+		if asCons == Nil {
+			// A binding without a value makes the whole `let` ():
+			for range names {
+				c.emit(opPop, 0)
+			}
+			c.emit(opNil, 0)
+			return nil
+		}
+		c.expr(asCons.car, false)
+		if _, ok := binding.car.(*ConsCell); ok {
+			c.emit(opDestructure, c.constant(binding.car))
+		}
+		names = append(names, bound...)
+		if _, ok := bindings.cdr.(*ConsCell); !ok {
+			return baseError("let bindings must be a list")
+		}
+	}
+	if bindsT(names) {
+		c.emit(opFail, c.constant(errorList(
+			extendError("setting let bindings", baseError("cannot bind or set t")))))
+		return nil
+	}
+	saved := c.scope
+	c.scope = &scope{names: names, parent: saved}
+	c.code.lets = append(c.code.lets, letInfo{len(names), c.scope})
+	c.emit(opLet, len(c.code.lets)-1)
+	c.body(exprs, tail)
+	c.scope = saved
+	if !tail {
+		c.emit(opPopEnv, 0)
+	}
+	return nil
+}
+
+// letfn compiles (letfn ((name args body...) ...) body...).  The
+// functions are made in a new scope which binds all their names, so they
+// can call each other, as can the body.
+func (c *compiler) letfn(args *ConsCell, tail bool) error {
+	if args == Nil {
+		return baseError("letfn requires a list of function definitions")
+	}
+	defs, err := consToExprs(args.car)
+	if err != nil {
+		return baseError("letfn requires a list of function definitions")
+	}
+	exprs, err := consToExprs(args.cdr)
+	if err != nil {
+		return baseError("letfn requires a body")
+	}
+	names := []Atom{}
+	fns := []*lambdaFn{}
+	for _, def := range defs {
+		d, ok := def.(*ConsCell)
+		if !ok || d == Nil {
+			return baseError("a letfn definition must be a list (name args body...)")
+		}
+		name, ok := d.car.(Atom)
+		if !ok {
+			return baseError("a letfn definition must start with a name")
+		}
+		rest, ok := d.cdr.(*ConsCell)
+		if !ok || rest == Nil {
+			return baseErrorf("letfn definition of %s requires an argument list", name)
+		}
+		fn, err := mkLambda(rest, false)
+		if err != nil {
+			return extendError(fmt.Sprintf("letfn definition of %s", name), err)
+		}
+		fn.defName = name
+		names = append(names, name)
+		fns = append(fns, fn)
+	}
+	if bindsT(names) {
+		return extendError("setting letfn bindings", baseError("cannot bind or set t"))
+	}
+	saved := c.scope
+	c.scope = &scope{names: names, parent: saved}
+	c.code.lets = append(c.code.lets, letInfo{0, c.scope})
+	c.emit(opLet, len(c.code.lets)-1)
+	for i, fn := range fns {
+		c.emit(opLambda, c.constant(c.lambdaCode(fn)))
+		c.emit(opSetLocal, c.ref(names[i], 0, i))
+		c.emit(opPop, 0)
+	}
+	c.body(exprs, tail)
+	c.scope = saved
+	if !tail {
+		c.emit(opPopEnv, 0)
+	}
+	return nil
+}
+
+// bindingNames returns the names bound by the name or pattern (see
+// destructure.go) on the left of a let binding.
+func bindingNames(x Sexpr) ([]Atom, error) {
+	switch t := x.(type) {
+	case Atom:
+		return []Atom{t}, nil
+	case *ConsCell:
+		if t != Nil {
+			return patternNames(t)
+		}
+	}
+	return nil, baseError("a let binding must be a list of binding pairs")
+}
+
+func bindsT(names []Atom) bool {
+	for _, name := range names {
+		if name == True {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a human-readable listing of the code, for debugging.
+func (c *code) String() string {
+	ret := ""
+	for pc, in := range c.instrs {
+		ret += fmt.Sprintf("%4d %s %d\n", pc, opNames[in.op], in.arg)
+	}
+	return ret
+}
+
+var opNames = map[opcode]string{
+	opConst:       "CONST",
+	opNil:         "NIL",
+	opTrue:        "TRUE",
+	opLookup:      "LOOKUP",
+	opLocal:       "LOCAL",
+	opGlobal:      "GLOBAL",
+	opPop:         "POP",
+	opSetTop:      "SETTOP",
+	opJump:        "JUMP",
+	opJumpIfNil:   "JUMPIFNIL",
+	opJumpIfTrue:  "JUMPIFTRUE",
+	opMacroGuard:  "MACROGUARD",
+	opMacroCheck:  "MACROCHECK",
+	opCall:        "CALL",
+	opTailCall:    "TAILCALL",
+	opReturn:      "RETURN",
+	opLambda:      "LAMBDA",
+	opDef:         "DEF",
+	opDefvar:      "DEFVAR",
+	opDefn:        "DEFN",
+	opSet:         "SET",
+	opSetLocal:    "SETLOCAL",
+	opLet:         "LET",
+	opPopEnv:      "POPENV",
+	opRaise:       "RAISE",
+	opRethrow:     "RETHROW",
+	opFail:        "FAIL",
+	opPushHandler: "PUSHHANDLER",
+	opPopHandler:  "POPHANDLER",
+	opBlock:       "BLOCK",
+	opReturnFrom:  "RETURNFROM",
+	opPushCleanup: "PUSHCLEANUP",
+	opEndCleanup:  "ENDCLEANUP",
+	opUnsupplied:  "UNSUPPLIED",
+	opDestructure: "DESTRUCTURE",
+	opBind:        "BIND",
+	opUnbind:      "UNBIND",
+	opErrorsSig:   "ERRORSSIG",
+	opErrorsMatch: "ERRORSMATCH",
+	opTestBegin:   "TESTBEGIN",
+	opTestStep:    "TESTSTEP",
+	opTestEnd:     "TESTEND",
+}
@@ -0,0 +1,365 @@
+package lisp
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// task is a function call running on its own goroutine, started by spawn.
+type task struct {
+	// Closed once the call has returned:
+	done chan struct{}
+	val  Sexpr
+	err  error
+}
+
+func (t *task) String() string {
+	return "<task>"
+}
+
+func (t *task) Equal(o Sexpr) bool {
+	return t == o
+}
+
+// spawn calls fn with args on a new goroutine, and so a new thread, which
+// starts out with the bindings in force where spawn was called.
+func spawn(fn Sexpr, args []Sexpr, e *Env) *task {
+	t := &task{done: make(chan struct{})}
+	th := threadOf(e).fork()
+	go func() {
+		defer close(t.done)
+		t.val, t.err = th.call(fn, args, e)
+		if t.err != nil {
+			// Continuations and blocks belonging to the spawning VM
+			// can't be reached from here:
+			t.err = errorList(t.err)
+		}
+	}()
+	return t
+}
+
+// join waits for the task's function to return, unless the evaluation
+// waiting, limited by lim, is stopped first, then returns its result.
+func (t *task) join(lim *limits) (Sexpr, error) {
+	if err := lim.wait(t.done); err != nil {
+		return nil, err
+	}
+	if t.err != nil {
+		return nil, extendError("spawned function", t.err)
+	}
+	return t.val, nil
+}
+
+// future is the value of the future form: its body, running on a task of
+// its own.
+type future struct {
+	t *task
+}
+
+func (f *future) String() string {
+	return "<future>"
+}
+
+func (f *future) Equal(o Sexpr) bool {
+	return f == o
+}
+
+// mkFuture is called by the code compiled for the future form, with a
+// function of no arguments wrapping its body.
+var mkFuture = &Builtin{Name: "future", FixedArity: 1}
+
+func mkFutureFn(args []Sexpr, e *Env) (Sexpr, error) {
+	return &future{spawn(args[0], nil, e)}, nil
+}
+
+// promise is a value to be supplied later, once, with deliver.
+type promise struct {
+	// Closed once the value has been delivered:
+	done chan struct{}
+	mu   sync.Mutex
+	val  Sexpr
+}
+
+func (p *promise) String() string {
+	return "<promise>"
+}
+
+func (p *promise) Equal(o Sexpr) bool {
+	return p == o
+}
+
+func (p *promise) deliver(x Sexpr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		return baseError("promise already delivered")
+	default:
+	}
+	p.val = x
+	close(p.done)
+	return nil
+}
+
+// deref waits for the value of a future or promise, unless the evaluation
+// is stopped first, or forces a delay on behalf of e.
+func deref(x Sexpr, e *Env) (Sexpr, error) {
+	switch t := x.(type) {
+	case *future:
+		if err := threadOf(e).lim.wait(t.t.done); err != nil {
+			return nil, err
+		}
+		if t.t.err != nil {
+			return nil, extendError("future", t.t.err)
+		}
+		return t.t.val, nil
+	case *promise:
+		if err := threadOf(e).lim.wait(t.done); err != nil {
+			return nil, err
+		}
+		return t.val, nil
+	case *delay:
+		return t.force(e)
+	default:
+		return nil, baseErrorf("'%s' is not a future, promise or delay", x)
+	}
+}
+
+// parallel calls f(i) for each i from 0 to n-1, spread over GOMAXPROCS
+// goroutines, and waits for them all.  If any calls fail, the error from
+// the first of them (by i, not by time) is returned.
+func parallel(n int, f func(i int) error) error {
+	errs := make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0) && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return errorList(err)
+		}
+	}
+	return nil
+}
+
+// pmap applies fn to each element of xs in parallel, each on a thread of
+// its own forked from the caller's, returning the results in the same order
+// as xs.
+func pmap(fn Sexpr, xs []Sexpr, e *Env) (Sexpr, error) {
+	ret := make([]Sexpr, len(xs))
+	th := threadOf(e)
+	err := parallel(len(xs), func(i int) (err error) {
+		ret[i], err = th.fork().call(fn, []Sexpr{xs[i]}, e)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list(ret...), nil
+}
+
+// preduce reduces xs with fn, which must be associative, by splitting it
+// into one run of elements per GOMAXPROCS, reducing the runs in parallel,
+// and then reducing their results in order.  acc, if not nil, is combined
+// with the first element of the first run.
+func preduce(fn Sexpr, acc Sexpr, xs []Sexpr, e *Env) (Sexpr, error) {
+	if acc != nil {
+		xs = append([]Sexpr{acc}, xs...)
+	}
+	if len(xs) == 0 {
+		return callFn(fn, nil, e)
+	}
+	n := runtime.GOMAXPROCS(0)
+	if n > len(xs) {
+		n = len(xs)
+	}
+	runs := make([]Sexpr, n)
+	reduce := func(th *thread, xs []Sexpr) (Sexpr, error) {
+		ret := xs[0]
+		for _, x := range xs[1:] {
+			var err error
+			if ret, err = th.call(fn, []Sexpr{ret, x}, e); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	th := threadOf(e)
+	err := parallel(n, func(i int) (err error) {
+		runs[i], err = reduce(th.fork(), xs[i*len(xs)/n:(i+1)*len(xs)/n])
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reduce(th, runs)
+}
+
+// channel carries values between goroutines.
+type channel struct {
+	ch chan Sexpr
+}
+
+// The most values a channel can hold, as room for them is allocated when
+// it is made:
+const maxChanSize = 1 << 20
+
+func (c *channel) String() string {
+	return "<channel>"
+}
+
+func (c *channel) Equal(o Sexpr) bool {
+	return c == o
+}
+
+func asChannel(x Sexpr) (*channel, error) {
+	c, ok := x.(*channel)
+	if !ok {
+		return nil, baseErrorf("'%s' is not a channel", x)
+	}
+	return c, nil
+}
+
+// send sends x on the channel, waiting until there is room for it, or
+// until the evaluation is stopped (see limits.block).  Go panics on sending
+// to a closed channel; here, that's an error.
+func (c *channel) send(x Sexpr, lim *limits) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = baseError("send on closed channel")
+		}
+	}()
+	if err := lim.block(); err != nil {
+		return err
+	}
+	select {
+	case c.ch <- x:
+		return nil
+	case <-lim.cancelled():
+		return lim.block()
+	}
+}
+
+// recv receives a value from the channel, waiting until there is one, or
+// until the evaluation is stopped, or returns () once the channel is closed
+// and empty.
+func (c *channel) recv(lim *limits) (Sexpr, error) {
+	if err := lim.block(); err != nil {
+		return nil, err
+	}
+	select {
+	case x, ok := <-c.ch:
+		if !ok {
+			return Nil, nil
+		}
+		return x, nil
+	case <-lim.cancelled():
+		return nil, lim.block()
+	}
+}
+
+func (c *channel) close() (err error) {
+	defer func() {
+		if recover() != nil {
+			err = baseError("channel already closed")
+		}
+	}()
+	close(c.ch)
+	return nil
+}
+
+// Atoms which start the clauses of a select form:
+var (
+	symRecv    = Intern("recv")
+	symSend    = Intern("send")
+	symDefault = Intern("default")
+)
+
+// selectCtl carries out the select form, which compiles to a call of
+// selectFn with four arguments per clause: the clause's kind (recv, send
+// or default), its channel, the value to send, and a function of the
+// clause's body.  The function of the clause chosen is then called in
+// place of the select, with the value received, if any.
+func selectCtl(m *vm, base int, tail bool) error {
+	args := m.stack[base+1:]
+	cases := make([]reflect.SelectCase, 0, len(args)/4)
+	fns := make([]Sexpr, 0, len(args)/4)
+	for i := 0; i+3 < len(args); i += 4 {
+		kind, ch, val, fn := args[i], args[i+1], args[i+2], args[i+3]
+		sc := reflect.SelectCase{Dir: reflect.SelectDefault}
+		if kind != symDefault {
+			c, err := asChannel(ch)
+			if err != nil {
+				return extendError("select", err)
+			}
+			sc.Chan = reflect.ValueOf(c.ch)
+			sc.Dir = reflect.SelectRecv
+			if kind == symSend {
+				sc.Dir = reflect.SelectSend
+				sc.Send = reflect.ValueOf(&val).Elem()
+			}
+		}
+		cases = append(cases, sc)
+		fns = append(fns, fn)
+	}
+	chosen, recv, ok, err := doSelect(cases, m.lim)
+	if err != nil {
+		return err
+	}
+	m.stack = append(m.stack[:base], fns[chosen])
+	if cases[chosen].Dir == reflect.SelectRecv {
+		var x Sexpr = Nil
+		if ok {
+			x = recv.Interface().(Sexpr)
+		}
+		m.push(x)
+	}
+	return m.call(base, tail)
+}
+
+// doSelect waits for one of the cases to be ready, or for the evaluation to
+// be stopped, turning the panic from sending to a closed channel into an
+// error.
+func doSelect(cases []reflect.SelectCase, lim *limits) (chosen int, recv reflect.Value, ok bool, err error) {
+	defer func() {
+		if recover() != nil {
+			err = baseError("send on closed channel")
+		}
+	}()
+	if err = lim.block(); err != nil {
+		return
+	}
+	n := len(cases)
+	if done := lim.cancelled(); done != nil {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(done),
+		})
+	}
+	chosen, recv, ok = reflect.Select(cases)
+	if chosen == n {
+		err = lim.block()
+	}
+	return
+}
+
+var selectFn = &Builtin{Name: "select", NAry: true}
+
+func init() {
+	// Set here, as these refer (via the compiler) back to themselves:
+	selectFn.ctl = selectCtl
+	mkFuture.Fn = mkFutureFn
+}
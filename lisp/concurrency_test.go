@@ -0,0 +1,99 @@
+package lisp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Evaluations in separate goroutines may share a top-level environment;
+// run with -race to check that they do so safely.
+func TestConcurrentEval(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore, &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			code := fmt.Sprintf(`(defmacro twice-%d (x) (list '* 2 x))
+                                 (defn f-%d () (twice-%d %d))
+                                 (def g-%d (gensym))
+                                 (def v-%d (join (spawn f-%d)))`,
+				i, i, i, i, i, i, i)
+			if err := LexParseEval(code, &globals); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	seen := map[Sexpr]bool{}
+	for i := 0; i < 10; i++ {
+		v, ok := globals.Lookup(fmt.Sprintf("v-%d", i))
+		if !ok {
+			t.Fatalf("v-%d not defined", i)
+		}
+		if !v.Equal(Num(2 * i)) {
+			t.Errorf("v-%d: got %s, want %d", i, v, 2*i)
+		}
+		g, ok := globals.Lookup(fmt.Sprintf("g-%d", i))
+		if !ok {
+			t.Fatalf("g-%d not defined", i)
+		}
+		if seen[g] {
+			t.Errorf("gensym %s made twice", g)
+		}
+		seen[g] = true
+	}
+}
+
+// A binding made by one task is not seen by another binding the same
+// special variable at the same time, nor by the spawning goroutine.
+func TestConcurrentBinding(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore, &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := `(defvar *x* 'global)
+                 (defn get-x () *x*)
+                 (def ready (chan 2))
+                 (def proceed (chan 2))
+                 (defn bind-x (v)
+                   (binding ((*x* v))
+                     (send ready (get-x))
+                     (recv proceed)
+                     (set! *x* (list v v))
+                     (get-x)))
+                 (def a (spawn bind-x 'a))
+                 (def b (spawn bind-x 'b))
+                 (def seen (list (recv ready) (recv ready) (get-x)))
+                 (send proceed t)
+                 (send proceed t)
+                 (def result (list (join a) (join b) (get-x)))
+                 (def inherited (binding ((*x* 'outer))
+                                  (list (join (spawn get-x))
+                                        (pmap (lambda (_) (get-x)) '(1 2)))))`
+	if err := LexParseEval(code, &globals); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ name, want string }{
+		{"result", "((a a) (b b) global)"},
+		{"inherited", "(outer (outer outer))"},
+	} {
+		v, ok := globals.Lookup(c.name)
+		if !ok {
+			t.Fatalf("%s not defined", c.name)
+		}
+		if v.String() != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, v, c.want)
+		}
+	}
+	seen, _ := globals.Lookup("seen")
+	if s := seen.String(); s != "(a b global)" && s != "(b a global)" {
+		t.Errorf("seen: got %s, want a, b and global", s)
+	}
+}
@@ -16,19 +16,33 @@ func (c *ConsCell) Error() string {
 // of one item.
 var Nil *ConsCell = nil
 
+// String renders a list.  Rendering runs no code: the tails of lazy
+// sequences which have not been forced yet are shown as "...", as are any
+// elements past the first PrintLength (see forcePrinted).
 func (c *ConsCell) String() string {
 	ret := "("
 	car := c
-	for {
+	lazy := false
+	for n := 1; ; n++ {
 		if car == Nil {
 			break
 		}
 		ret += car.car.String()
-		cdr, ok := car.cdr.(*ConsCell)
+		if _, ok := car.cdr.(*delay); ok {
+			lazy = true
+		}
+		tail, ok := forcedTail(car.cdr)
 		if !ok {
-			return ret + " . " + car.cdr.String() + ")"
+			return ret + " ...)"
+		}
+		cdr, ok := tail.(*ConsCell)
+		if !ok {
+			return ret + " . " + tail.String() + ")"
 		}
 		if cdr != Nil {
+			if lazy && n >= PrintLength {
+				return ret + " ...)"
+			}
 			ret += " "
 		}
 		car = cdr
@@ -41,17 +55,45 @@ func Cons(i Sexpr, cdr Sexpr) *ConsCell {
 	return &ConsCell{i, cdr}
 }
 
-// Equal returns true iff the two S-expressions are equal cons-wise
+// Equal returns true iff the two S-expressions are equal cons-wise.  Lazy
+// sequences are forced as far as needed; if that raises an error, they are
+// taken to be unequal (= reports the error instead).
 func (c *ConsCell) Equal(o Sexpr) bool {
-	_, ok := o.(*ConsCell)
-	if !ok {
-		return false
-	}
-	if c == Nil {
-		return o == Nil
-	}
-	if o == Nil {
-		return c == Nil
+	eq, err := equal(c, o, nil, nil)
+	return err == nil && eq
+}
+
+// equal compares two S-expressions as Equal does, walking lists in a loop
+// so that long lazy sequences don't exhaust the Go stack.  Lazy sequences
+// are forced on behalf of e, and each element compared counts as a step
+// against lim, if given; errors from either are returned.
+func equal(a, b Sexpr, e *Env, lim *limits) (bool, error) {
+	for {
+		c, ok := a.(*ConsCell)
+		if !ok {
+			return a.Equal(b), nil
+		}
+		o, ok := b.(*ConsCell)
+		if !ok {
+			return false, nil
+		}
+		if c == Nil || o == Nil {
+			return c == o, nil
+		}
+		if lim != nil {
+			if err := lim.step(); err != nil {
+				return false, err
+			}
+		}
+		eq, err := equal(c.car, o.car, e, lim)
+		if err != nil || !eq {
+			return false, err
+		}
+		if a, err = forceTail(c.cdr, e); err != nil {
+			return false, err
+		}
+		if b, err = forceTail(o.cdr, e); err != nil {
+			return false, err
+		}
 	}
-	return c.car.Equal(o.(*ConsCell).car) && c.cdr.Equal(o.(*ConsCell).cdr)
 }
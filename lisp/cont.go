@@ -0,0 +1,83 @@
+package lisp
+
+import "fmt"
+
+// continuation is a captured control point: the state of a VM at the moment
+// `call/cc` was called.  Continuations may be invoked any number of times.
+type continuation struct {
+	m        *vm
+	stack    []Sexpr
+	frames   []frame
+	handlers []handler
+}
+
+func (k *continuation) String() string {
+	return "<continuation>"
+}
+
+func (k *continuation) Equal(o Sexpr) bool {
+	return false
+}
+
+// contInvoke is returned, in place of an error, when a continuation is
+// invoked.  It passes up through any intervening Go code (builtins calling
+// l1 functions) to the VM which captured the continuation, bypassing error
+// handlers along the way.
+type contInvoke struct {
+	k   *continuation
+	val Sexpr
+}
+
+func (ci *contInvoke) Error() string {
+	return fmt.Sprintf("continuation invoked with %s", ci.val)
+}
+
+// capture makes a continuation which, when invoked, will deliver its value
+// as the result of the call to the builtin at stack[base].
+func (m *vm) capture(base int, tail bool) *continuation {
+	frames := m.frames
+	if tail {
+		// The call's value is the current frame's value:
+		base = frames[len(frames)-1].base
+		frames = frames[:len(frames)-1]
+	}
+	return &continuation{
+		m:        m,
+		stack:    append([]Sexpr{}, m.stack[:base]...),
+		frames:   append([]frame{}, frames...),
+		handlers: append([]handler{}, m.handlers...),
+	}
+}
+
+// resume restores the state captured in k, with x as the result of the
+// `call/cc` call.
+func (m *vm) resume(k *continuation, x Sexpr) {
+	m.stack = append(m.stack[:0], k.stack...)
+	m.frames = append(m.frames[:0], k.frames...)
+	m.handlers = append(m.handlers[:0], k.handlers...)
+	m.push(x)
+}
+
+// sharedHandlers returns how many of the VM's current handlers will still be
+// active once k is resumed.
+func (m *vm) sharedHandlers(k *continuation) int {
+	if k.m != m {
+		return 0
+	}
+	n := 0
+	for n < len(m.handlers) && n < len(k.handlers) && m.handlers[n] == k.handlers[n] {
+		n++
+	}
+	return n
+}
+
+// callCC calls its function argument with the current continuation.
+func callCC(m *vm, base int, tail bool) error {
+	if len(m.stack)-base != 2 {
+		return baseError("call/cc expects a single argument")
+	}
+	k := m.capture(base, tail)
+	m.stack[base] = m.stack[base+1]
+	m.stack[base+1] = k
+	return m.call(base, tail)
+}
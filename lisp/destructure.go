@@ -0,0 +1,82 @@
+package lisp
+
+// Destructuring: wherever a name can be bound by `let`, as a required
+// lambda argument, or by `foreach`, a pattern may be given instead.  A
+// pattern is a name, or a list of patterns, possibly with a dotted tail,
+// e.g. (a (b c) . more).  () in a pattern matches only ().
+
+// patternNames returns the names a pattern binds, depth first, left to
+// right, or an error if the pattern is malformed.
+func patternNames(pattern Sexpr) ([]Atom, error) {
+	names := []Atom{}
+	var walk func(p Sexpr) error
+	walk = func(p Sexpr) error {
+		switch t := p.(type) {
+		case Atom:
+			names = append(names, t)
+			return nil
+		case *ConsCell:
+			for t != Nil {
+				if err := walk(t.car); err != nil {
+					return err
+				}
+				switch cdr := t.cdr.(type) {
+				case *ConsCell:
+					t = cdr
+				case Atom:
+					names = append(names, cdr)
+					return nil
+				default:
+					return baseErrorf("'%s' in a pattern is not a name or a list", cdr)
+				}
+			}
+			return nil
+		default:
+			return baseErrorf("'%s' in a pattern is not a name or a list", p)
+		}
+	}
+	if err := walk(pattern); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// destructure matches a value against a (well-formed) pattern, appending
+// the values of the pattern's names, in the order of patternNames, to vals.
+func destructure(pattern, value Sexpr, vals []Sexpr) ([]Sexpr, error) {
+	ret, ok := match(pattern, value, vals)
+	if !ok {
+		return nil, startStacktrace(list(Intern("pattern"), pattern,
+			Intern("does"), Intern("not"), Intern("match"), value))
+	}
+	return ret, nil
+}
+
+func match(pattern, value Sexpr, vals []Sexpr) ([]Sexpr, bool) {
+	switch p := pattern.(type) {
+	case Atom:
+		return append(vals, value), true
+	case *ConsCell:
+		v, ok := value.(*ConsCell)
+		if !ok {
+			return nil, false
+		}
+		for p != Nil {
+			if v == Nil {
+				return nil, false
+			}
+			if vals, ok = match(p.car, v.car, vals); !ok {
+				return nil, false
+			}
+			if _, ok := p.cdr.(Atom); ok {
+				return append(vals, v.cdr), true
+			} else if rest, ok := v.cdr.(*ConsCell); ok {
+				p, v = p.cdr.(*ConsCell), rest
+			} else {
+				return nil, false
+			}
+		}
+		return vals, v == Nil
+	}
+	return nil, false
+}
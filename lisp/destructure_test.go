@@ -0,0 +1,103 @@
+package lisp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDestructure(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		value   string
+		out     string
+		err     string
+	}{
+		{"a", "(1 2)", "((1 2))", ""},
+		{"(a b)", "(1 2)", "(1 2)", ""},
+		{"(a (b c) . d)", "(1 (2 3) 4 5)", "(1 2 3 (4 5))", ""},
+		{"(a . b)", "(1)", "(1 ())", ""},
+		{"(a ())", "(1 ())", "(1)", ""},
+		{"(a b)", "(1)", "", "pattern (a b) does not match (1)"},
+		{"(a b)", "(1 2 3)", "", "pattern (a b) does not match (1 2 3)"},
+		{"(a b)", "(1 . 2)", "", "does not match"},
+		{"((a) b)", "(1 2)", "", "does not match"},
+		{"(a ())", "(1 2)", "", "does not match"},
+		{"(a 1)", "(1 1)", "", "'1' in a pattern is not a name or a list"},
+		{"(a . 1)", "(1 1)", "", "'1' in a pattern is not a name or a list"},
+	}
+	for _, test := range tests {
+		exprs, err := lexAndParse(strings.Split("("+test.pattern+" "+test.value+")", "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pv := exprs[0].(*ConsCell)
+		pattern, value := pv.car, pv.cdr.(*ConsCell).car
+		names, err := patternNames(pattern)
+		var vals []Sexpr
+		if err == nil {
+			vals, err = destructure(pattern, value, nil)
+		}
+		if err != nil {
+			if test.err == "" || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s against %s: got error %q, want %q", test.pattern, test.value, err, test.err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("%s against %s: expected error %q, got none", test.pattern, test.value, test.err)
+			continue
+		}
+		if len(names) != len(vals) {
+			t.Errorf("%s: %d names but %d values", test.pattern, len(names), len(vals))
+		}
+		if got := mkListAsConsWithCdr(vals, Nil).String(); got != test.out {
+			t.Errorf("%s against %s: got %s, want %s", test.pattern, test.value, got, test.out)
+		}
+	}
+}
+
+func TestPatternArguments(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore, &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		out string
+		err string
+	}{
+		// A pattern argument followed by a body whose first form is a
+		// call to a lambda isn't read as a multi-arity function:
+		{"(defn f ((a b) c) ((lambda (x) (list x a b c)) 0))", "()", ""},
+		{"(f '(1 2) 3)", "(0 1 2 3)", ""},
+		{"(defn g ((a b) c) ((if a car cdr) c))", "()", ""},
+		{"(g '(1 2) '(3 4))", "3", ""},
+		// ... only clauses following &arities are:
+		{"(defn h &arities ((x) x) ((x y) (+ x y)))", "()", ""},
+		{"(h 1 2)", "3", ""},
+		{"(defn k &arities ((x) (g x '(4 5))) ((x y) y))", "()", ""},
+		{"(k '(() 1))", "(5)", ""},
+		{"(k 1 2)", "2", ""},
+	}
+	for _, test := range tests {
+		exprs, err := lexAndParse([]string{test.in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev, err := eval(exprs[0], &globals)
+		if err != nil {
+			if test.err == "" || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %q, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("%s: expected error %q, got none", test.in, test.err)
+			continue
+		}
+		if ev.String() != test.out {
+			t.Errorf("%s: got %q, want %q", test.in, ev, test.out)
+		}
+	}
+}
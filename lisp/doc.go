@@ -24,9 +24,12 @@ type formRec struct {
 	ftype     string
 	args      *ConsCell
 	examples  string
+	// For functions taking a limited number of arguments beyond farity,
+	// the most they take:
+	maxArity int
 }
 
-func a(s string) Sexpr { return Atom{s} }
+func a(s string) Sexpr { return Intern(s) }
 
 // When you add a special form to eval, you should add it here as well:
 var specialForms = []formRec{
@@ -35,7 +38,7 @@ var specialForms = []formRec{
 		farity:    0,
 		isSpecial: true,
 		ismulti:   true,
-		doc:       convertStringToDoc("Boolean and"),
+		doc:       convertStringToDoc("Boolean and, returning the last value if none is ()"),
 		ftype:     special,
 		args:      Cons(Nil, a("xs")),
 		examples: `(and)
@@ -47,9 +50,52 @@ true
 > (and t t ())
 ;;=>
 ()
+> (and 1 2)
+;;=>
+2
 > (and () (/ 1 0))
 ;;=>
 ()
+`,
+	},
+	{
+		name:      "binding",
+		farity:    1,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Rebind special variables for the duration of body"),
+		ftype:     special,
+		args:      Cons(a("bindings"), a("body")),
+		examples: `> (defvar *greeting* 'hello)
+;;=>
+hello
+> (defn greet (x) (list *greeting* x))
+;;=>
+()
+> (binding ((*greeting* 'goodbye))
+    (greet 'world))
+;;=>
+(goodbye world)
+> (greet 'world)
+;;=>
+(hello world)
+`,
+	},
+	{
+		name:      "block",
+		farity:    1,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Evaluate body in a named block which can be exited with return-from"),
+		ftype:     special,
+		args:      Cons(a("name"), a("body")),
+		examples: `> (block outer
+    (foreach x '(1 2 3 4)
+      (when (= x 3)
+        (return-from outer x)))
+    'not-found)
+;;=>
+3
 `,
 	},
 	{
@@ -82,6 +128,22 @@ true
 > a
 ;;=>
 1
+`,
+	},
+	{
+		name:      "defvar",
+		farity:    2,
+		isSpecial: true,
+		ismulti:   false,
+		doc:       convertStringToDoc("Set a value, and make name a special variable"),
+		ftype:     special,
+		args:      list(a("name"), a("value")),
+		examples: `> (defvar *indent* 0)
+;;=>
+0
+> (binding ((*indent* 4)) *indent*)
+;;=>
+4
 `,
 	},
 	{
@@ -131,6 +193,106 @@ true
 ;;=>
 24
 	`,
+	},
+	{
+		name:      "defmethod",
+		farity:    3,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Add a method to a multimethod, for a dispatch value"),
+		ftype:     special,
+		args:      Cons(a("name"), Cons(a("value"), Cons(a("args"), a("body")))),
+		examples: `> (defmulti speak car)
+;;=>
+()
+> (defmethod speak 'dog (_) 'woof)
+;;=>
+()
+> (defmethod speak :default (x) (list 'silence 'from (car x)))
+;;=>
+()
+> (speak '(dog rex))
+;;=>
+woof
+> (speak '(fish wanda))
+;;=>
+(silence from fish)
+`,
+	},
+	{
+		name:      "defmulti",
+		farity:    2,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Create and name a multimethod, which calls the method for the value of its dispatch function"),
+		ftype:     special,
+		args:      Cons(a("name"), a("dispatch")),
+		examples: `> (defmulti area (doc (area of a shape)) car)
+;;=>
+()
+> (defmethod area 'square (s) (* (cadr s) (cadr s)))
+;;=>
+()
+> (area '(square 3))
+;;=>
+9
+> area
+;;=>
+<multimethod area>
+> (doc area)
+;;=>
+((area of a shape) (methods: square))
+`,
+	},
+	{
+		name:      "defsyntax",
+		farity:    2,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Create and name a macro from pattern and template rules"),
+		ftype:     special,
+		args:      Cons(a("name"), Cons(a("literals"), a("rules"))),
+		examples: `> (defsyntax swap! ()
+    ((_ a b) (let ((tmp a))
+               (set! a b)
+               (set! b tmp))))
+;;=>
+()
+> (let ((tmp 1) (x 2))
+    (swap! tmp x)
+    (list tmp x))
+;;=>
+(2 1)
+> (defsyntax my-and ()
+    ((_) t)
+    ((_ x) x)
+    ((_ x more ...) (if x (my-and more ...) ())))
+;;=>
+()
+> (my-and 1 2 3)
+;;=>
+3
+`,
+	},
+	{
+		name:      "delay",
+		farity:    0,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Put off evaluating body until the first time the delay is forced"),
+		ftype:     special,
+		args:      Cons(Nil, a("body")),
+		examples: `> (def d (delay (printl '(thinking hard)) 42))
+;;=>
+<delay>
+> (force d)
+thinking hard
+;;=>
+42
+> (force d)
+;;=>
+42
+`,
 	},
 	{
 		name:      "error",
@@ -168,6 +330,49 @@ ERROR in '(ensure-list 3)':
 ;;=>
 ERROR in '(errors (quote (is not a function)) (+))':
 error not found in ((quote (is not a function)) (+))
+`,
+	},
+	{
+		name:      "future",
+		farity:    0,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Start evaluating body in the background, returning a future whose value deref waits for"),
+		ftype:     special,
+		args:      Cons(Nil, a("body")),
+		examples: `> (def f (future (+ 1 2)))
+;;=>
+<future>
+> (deref f)
+;;=>
+3
+`,
+	},
+	{
+		name:      "generator",
+		farity:    0,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Make a generator, whose body runs each time next is called, until it yields a value"),
+		ftype:     special,
+		args:      Cons(Nil, a("body")),
+		examples: `> (def g (generator
+           (yield 'ready)
+           (yield 'set)))
+;;=>
+<generator>
+> (next g)
+;;=>
+ready
+> (next g)
+;;=>
+set
+> (next g)
+;;=>
+()
+> (done? g)
+;;=>
+t
 `,
 	},
 	{
@@ -207,6 +412,25 @@ t
     (+ a b))
 ;;=>
 3
+> (let (((a (b c) . d) '(1 (2 3) 4 5)))
+    (list a b c d))
+;;=>
+(1 2 3 (4 5))
+`,
+	},
+	{
+		name:      "letfn",
+		farity:    1,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Create a local scope with functions which can call each other"),
+		ftype:     special,
+		args:      Cons(a("definitions"), a("body")),
+		examples: `> (letfn ((ev? (n) (if (zero? n) t (od? (dec n))))
+          (od? (n) (if (zero? n) () (ev? (dec n)))))
+    (ev? 100))
+;;=>
+t
 `,
 	},
 	{
@@ -214,7 +438,7 @@ t
 		farity:    1,
 		isSpecial: true,
 		ismulti:   true,
-		doc:       convertStringToDoc("Loop forever"),
+		doc:       convertStringToDoc("Loop forever, or until break is called"),
 		ftype:     special,
 		args:      Nil,
 		examples: `> (loop
@@ -225,6 +449,13 @@ Help me, I am looping forever!
 Help me, I am looping forever!
 Help me, I am looping forever!
 ...
+> (let ((n 0))
+    (loop
+      (set! n (+ n 1))
+      (when (= n 10)
+        (break n))))
+;;=>
+10
 `,
 	},
 	{
@@ -232,7 +463,7 @@ Help me, I am looping forever!
 		farity:    0,
 		isSpecial: true,
 		ismulti:   true,
-		doc:       convertStringToDoc("Boolean or"),
+		doc:       convertStringToDoc("Boolean or, returning the first value which is not ()"),
 		ftype:     special,
 		args:      Cons(Nil, a("xs")),
 		examples: `> (or)
@@ -256,6 +487,53 @@ foo
 (1 2 3)
 > '(1 2 3)
 (1 2 3)
+`,
+	},
+	{
+		name:      "return-from",
+		farity:    1,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Exit the innermost enclosing block with the given name, returning value or ()"),
+		ftype:     special,
+		args:      Cons(a("name"), Cons(Nil, a("value"))),
+		examples: `> (block b
+    (return-from b 3)
+    4)
+;;=>
+3
+> (block b
+    (return-from b))
+;;=>
+()
+`,
+	},
+	{
+		name:      "select",
+		farity:    0,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Wait until one of the clauses' channel operations can proceed, then run that clause's body"),
+		ftype:     special,
+		args:      Cons(Nil, a("clauses")),
+		examples: `> (def c (chan 1))
+;;=>
+<channel>
+> (select
+    (recv c x (list 'got x))
+    (send c 'hello 'sent))
+;;=>
+sent
+> (select
+    (recv c x (list 'got x))
+    (default 'nothing))
+;;=>
+(got hello)
+> (select
+    (recv c x (list 'got x))
+    (default 'nothing))
+;;=>
+nothing
 `,
 	},
 	{
@@ -302,11 +580,15 @@ t
 		farity:    1,
 		isSpecial: true,
 		ismulti:   false,
-		doc:       convertStringToDoc("Syntax-quote an expression"),
+		doc:       convertStringToDoc("Syntax-quote an expression, replacing atoms ending in # with gensyms"),
 		ftype:     special,
 		args:      list(a("x")),
 		examples: `> (syntax-quote foo)
 foo
+> (= (car (syntax-quote (x# x#))) (cadr (syntax-quote (x# x#))))
+()
+` + "> (let ((x `(x# x#))) (= (car x) (cadr x)))" + `
+t
 > (syntax-quote (1 2 3 4))
 (1 2 3 4)
 > (syntax-quote (1 (unquote (+ 1 1)) (splicing-unquote (list 3 4))))
@@ -320,7 +602,7 @@ foo
 		farity:    0,
 		isSpecial: true,
 		ismulti:   true,
-		doc:       convertStringToDoc("Try to evaluate body, catch errors and handle them"),
+		doc:       convertStringToDoc("Try to evaluate body, catch errors and handle them, and run any finally clause on exit"),
 		ftype:     special,
 		args:      Cons(Nil, a("body")),
 		examples: `> (try (error '(boom)))
@@ -335,6 +617,13 @@ ERROR:
 (boom)
 > (try (/ 1 0) (catch e (len e)))
 2
+> (try
+    (/ 1 0)
+    (catch e 0)
+    (finally (printl '(cleaning up))))
+;;=>
+(cleaning up)
+0
 >
 `,
 	},
@@ -347,18 +636,48 @@ ERROR:
 		ftype:     special,
 		args:      Cons(Nil, a("body")),
 	},
+	{
+		name:      "unwind-protect",
+		farity:    1,
+		isSpecial: true,
+		ismulti:   true,
+		doc:       convertStringToDoc("Evaluate x, then cleanup forms, however x is exited"),
+		ftype:     special,
+		args:      Cons(a("x"), a("cleanup")),
+		examples: `> (unwind-protect
+    (+ 1 1)
+    (printl '(done)))
+;;=>
+(done)
+2
+> (block b
+    (unwind-protect
+      (return-from b 3)
+      (printl '(leaving))))
+;;=>
+(leaving)
+3
+`,
+	},
 }
 
 const columnsFormat = "%14s %2s %5s  %s"
 
-func formatFunctionInfo(name, shortDesc string,
-	arity int,
-	isMultiArity, isSpecial, isMacro, isNativeFn bool) string {
-
-	isMultiArityStr := " "
-	if isMultiArity {
-		isMultiArityStr = "+"
+// arityString describes how many arguments a form takes: e.g. 2, 2+ (or
+// more), or 2-3.
+func arityString(form formRec) string {
+	switch {
+	case form.ismulti:
+		return fmt.Sprintf("%d+", form.farity)
+	case form.maxArity > form.farity:
+		return fmt.Sprintf("%d-%d", form.farity, form.maxArity)
 	}
+	return fmt.Sprintf("%d", form.farity)
+}
+
+func formatFunctionInfo(name, shortDesc, arity string,
+	isSpecial, isMacro, isNativeFn bool) string {
+
 	formType := "F"
 	if isSpecial {
 		formType = "S"
@@ -367,11 +686,14 @@ func formatFunctionInfo(name, shortDesc string,
 	} else if isNativeFn {
 		formType = "N"
 	}
-	argstr := fmt.Sprintf("%d%s", arity, isMultiArityStr)
+	if !strings.ContainsAny(arity, "+-") {
+		// Line up with the numbers followed by +:
+		arity += " "
+	}
 	return fmt.Sprintf(columnsFormat,
 		name,
 		formType,
-		argstr,
+		arity,
 		capitalize(shortDesc))
 }
 
@@ -388,7 +710,7 @@ func functionExamplesFromDoc(l lambdaFn) *ConsCell {
 		if !ok || docCons == Nil {
 			return Nil
 		}
-		if docCons.car.Equal(Atom{"examples"}) {
+		if docCons.car.Equal(Intern("examples")) {
 			return doc.car.(*ConsCell).cdr.(*ConsCell)
 		}
 		doc = doc.cdr.(*ConsCell)
@@ -406,6 +728,9 @@ func examplesToString(examples *ConsCell, e *Env) string {
 			break
 		}
 		output, err := eval(example, e)
+		if err == nil {
+			err = forcePrinted(output, e)
+		}
 		if err != nil {
 			ret += fmt.Sprintf("> %s\n;;=>\nERROR: %s\n", example, err)
 		} else {
@@ -449,24 +774,18 @@ func availableForms(e *Env) ([]formRec, error) {
 		if l.isMacro {
 			ftype = macro
 		}
-		cl, err := consLength(l.args)
-		if err != nil {
-			return nil, extendError("availableForms", err)
-		}
-		args := l.args
-		if l.restArg != "" {
-			args = combineArgs(l.args, Atom{l.restArg})
-		}
+		min, max := l.argCounts()
 		if ok && l.doc != Nil {
 			examples := examplesToString(functionExamplesFromDoc(*l), e)
 			out = append(out, formRec{
 				name:     lambdaName,
-				farity:   cl,
+				farity:   min,
+				maxArity: max,
 				isMacro:  l.isMacro,
-				ismulti:  l.restArg != "",
+				ismulti:  max < 0,
 				doc:      l.doc,
 				ftype:    ftype,
-				args:     args,
+				args:     l.params(),
 				examples: examples,
 			})
 		}
@@ -523,10 +842,6 @@ func LongDocStr(e *Env) (string, error) {
 	summary += "\n# Operators\n"
 	outStrs := []string{summary}
 	for _, doc := range sortedForms {
-		isMulti := ""
-		if doc.ismulti {
-			isMulti = "+"
-		}
 		examples := ""
 		if doc.examples != "" {
 			examples = fmt.Sprintf("\n### Examples\n\n```\n%s\n```\n", doc.examples)
@@ -539,7 +854,7 @@ func LongDocStr(e *Env) (string, error) {
 
 Type: %s
 
-Arity: %d%s
+Arity: %s
 
 Args: %s
 
@@ -552,8 +867,7 @@ Args: %s
 			codeQuote(doc.name),
 			capitalize(docToString(doc.doc)),
 			doc.ftype,
-			doc.farity,
-			isMulti,
+			arityString(doc),
 			fmt.Sprintf("`%s`", doc.args),
 			examples))
 	}
@@ -588,8 +902,7 @@ func ShortDocStr(e *Env) (string, error) {
 	for _, doc := range af {
 		outStrs = append(outStrs, formatFunctionInfo(doc.name,
 			docToString(doc.doc),
-			doc.farity,
-			doc.ismulti,
+			arityString(doc),
 			doc.isSpecial,
 			doc.isMacro,
 			doc.isNative))
@@ -611,8 +924,8 @@ func formsAsSexprList(e *Env) ([]Sexpr, error) {
 		if form.ismulti {
 			multi = True
 		}
-		out = append(out, list(Atom{form.name},
-			Atom{strings.Replace(form.ftype, " ", "-", -1)},
+		out = append(out, list(Intern(form.name),
+			Intern(strings.Replace(form.ftype, " ", "-", -1)),
 			Num(form.farity),
 			multi,
 			form.args,
@@ -1,28 +1,117 @@
 package lisp
 
-import (
-	"fmt"
-)
+import "sync"
 
 // Env stores a local environment, possibly pointing to a caller's environment.
+// The top-level environment keeps its symbols in a map; local environments
+// (function calls, `let` and so on) keep theirs in slices, so that compiled
+// code can address them by position.
 type Env struct {
-	syms   map[string]Sexpr
+	syms   map[Atom]Sexpr
+	names  []Atom
+	vals   []Sexpr
 	parent *Env
+	// For the top-level environment, the special variables (see
+	// `defvar`):
+	specials map[Atom]bool
+	// For a top-level environment, guards syms and specials, which
+	// goroutines started by `spawn` share:
+	mu *sync.RWMutex
+	// For a local environment made by a VM for the code it runs, the VM's
+	// thread; for one made by thread.wrap, the thread of the Go code it was
+	// handed to:
+	th *thread
 }
 
 // mkEnv makes a new Env.
 func mkEnv(parent *Env) Env {
-	return Env{
-		syms:   map[string]Sexpr{},
+	if parent == nil {
+		return Env{syms: map[Atom]Sexpr{}, mu: &sync.RWMutex{}}
+	}
+	return Env{parent: parent}
+}
+
+// mkSlotEnv makes a local Env with the given names, whose values are to be
+// filled in by position.  The names slice is shared, not copied.
+func mkSlotEnv(parent *Env, names []Atom) *Env {
+	return &Env{
+		names:  names,
+		vals:   make([]Sexpr, len(names)),
 		parent: parent,
 	}
 }
 
+// slot returns the position of a symbol in a local environment, or -1.
+// Later bindings shadow earlier ones of the same name.
+func (e *Env) slot(s Atom) int {
+	for i := len(e.names) - 1; i >= 0; i-- {
+		if e.names[i] == s && e.vals[i] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// bindsLocally reports whether s is bound in e or a parent of it below
+// the top-level environment.
+func (e *Env) bindsLocally(s Atom) bool {
+	for ; e != nil && e.syms == nil; e = e.parent {
+		if e.slot(s) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// top returns the top-level environment.
+func (e *Env) top() *Env {
+	for e.parent != nil {
+		e = e.parent
+	}
+	return e
+}
+
+// declareSpecial makes a name, bound in the top-level environment e, a
+// special variable, which can be rebound by `binding`.
+func (e *Env) declareSpecial(s Atom) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.specials == nil {
+		e.specials = map[Atom]bool{}
+	}
+	e.specials[s] = true
+}
+
+// isSpecial reports whether s is a special variable in the top-level
+// environment e.
+func (e *Env) isSpecial(s Atom) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.specials[s]
+}
+
+// getTopLevel returns the value of a symbol in the top-level environment e.
+func (e *Env) getTopLevel(s Atom) (Sexpr, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	v, ok := e.syms[s]
+	return v, ok
+}
+
 // EnvKeys returns the keys of an environment, including any parents' keys.
 func EnvKeys(m *Env) []string {
 	ret := []string{}
-	for k := range m.syms {
-		ret = append(ret, k)
+	if m.syms != nil {
+		m.mu.RLock()
+		for k := range m.syms {
+			ret = append(ret, k.s)
+		}
+		m.mu.RUnlock()
+	}
+	for i, k := range m.names {
+		if m.vals[i] != nil {
+			ret = append(ret, k.s)
+		}
 	}
 	if m.parent != nil {
 		ret = append(ret, EnvKeys(m.parent)...)
@@ -32,55 +121,101 @@ func EnvKeys(m *Env) []string {
 
 // Lookup returns the value of a symbol in an environment or its parent(s).
 func (e *Env) Lookup(s string) (Sexpr, bool) {
-	if v, ok := e.syms[s]; ok {
-		return v, true
-	}
-	if e.parent != nil {
-		return e.parent.Lookup(s)
+	return e.lookup(Intern(s))
+}
+
+// lookup is Lookup, for an atom.
+func (e *Env) lookup(s Atom) (Sexpr, bool) {
+	for ; e != nil; e = e.parent {
+		if e.syms != nil {
+			if v, ok := e.getTopLevel(s); ok {
+				return v, true
+			}
+		} else if i := e.slot(s); i >= 0 {
+			return e.vals[i], true
+		}
 	}
 	return nil, false
 }
 
 // Set sets the value of a symbol in an environment.
 func (e *Env) Set(s string, v Sexpr) error {
-	if s == "t" {
+	return e.set(Intern(s), v)
+}
+
+// set is Set, for an atom.
+func (e *Env) set(s Atom, v Sexpr) error {
+	if s == True {
 		return baseError("cannot bind or set t")
 	}
-	e.syms[s] = v
+	if e.syms != nil {
+		e.mu.Lock()
+		e.syms[s] = v
+		e.mu.Unlock()
+		return nil
+	}
+	for i := len(e.names) - 1; i >= 0; i-- {
+		if e.names[i] == s {
+			e.vals[i] = v
+			return nil
+		}
+	}
+	// Copy rather than grow the names, which may be shared:
+	e.names = append(e.names[:len(e.names):len(e.names)], s)
+	e.vals = append(e.vals, v)
 	return nil
 }
 
 // SetTopLevel sets the value of a symbol in the top-level environment.
 func (e *Env) SetTopLevel(s string, v Sexpr) error {
-	if e.parent == nil {
-		return e.Set(s, v)
-	}
-	return e.parent.SetTopLevel(s, v)
+	return e.setTopLevel(Intern(s), v)
+}
+
+// setTopLevel is SetTopLevel, for an atom.
+func (e *Env) setTopLevel(s Atom, v Sexpr) error {
+	return e.top().set(s, v)
 }
 
 // Update updates the value of a symbol in an environment, or in a parent.
 func (e *Env) Update(s string, v Sexpr) error {
-	if s == "t" {
+	return e.update(Intern(s), v)
+}
+
+// update is Update, for an atom.
+func (e *Env) update(s Atom, v Sexpr) error {
+	if s == True {
 		return baseError("cannot bind or set t")
 	}
-	if _, ok := e.syms[s]; ok {
-		e.syms[s] = v
-		return nil
-	}
-	if e.parent != nil {
-		return e.parent.Update(s, v)
+	for ; e != nil; e = e.parent {
+		if e.syms != nil {
+			e.mu.Lock()
+			_, ok := e.syms[s]
+			if ok {
+				e.syms[s] = v
+			}
+			e.mu.Unlock()
+			if ok {
+				return nil
+			}
+		} else if i := e.slot(s); i >= 0 {
+			e.vals[i] = v
+			return nil
+		}
 	}
 	return baseErrorf("%s is not bound in any environment", s)
 }
 
+// String returns the printed representation of an environment, which is
+// opaque, as environments are first-class values (see `the-environment`).
 func (e *Env) String() string {
-	ret := ""
-	for k, v := range e.syms {
-		ret += fmt.Sprintf("%s=%s\n", k, v)
-	}
-	ret += "\n"
-	if e.parent != nil {
-		ret += fmt.Sprintf("PARENT: %s\n", e.parent.String())
+	if e.parent == nil {
+		return "<environment: top level>"
 	}
-	return ret
+	return "<environment>"
+}
+
+// Equal returns true only if o is the same environment.
+func (e *Env) Equal(o Sexpr) bool {
+	oe, ok := o.(*Env)
+	return ok && e == oe
 }
@@ -27,4 +27,25 @@ func TestEnv(t *testing.T) {
 	if err == nil {
 		t.Errorf("expected error setting t")
 	}
+
+	slots := mkSlotEnv(&child, []Atom{Intern("a"), Intern("c")})
+	slots.vals[0] = Num(4)
+	assertVal(slots, "a", Num(4))
+	assertVal(slots, "b", Num(2))
+	if _, found := slots.Lookup("c"); found {
+		t.Errorf("expected unfilled slot c to be unbound")
+	}
+	slots.Update("b", Num(5))
+	assertVal(&child, "b", Num(5))
+	slots.SetTopLevel("d", Num(6))
+	assertVal(&top, "d", Num(6))
+	if len(EnvKeys(slots)) != 4 {
+		t.Errorf("expected 4 keys, got %v", EnvKeys(slots))
+	}
+	if top.String() != "<environment: top level>" || slots.String() != "<environment>" {
+		t.Errorf("unexpected printed environments %s, %s", &top, slots)
+	}
+	if !slots.Equal(slots) || slots.Equal(&child) {
+		t.Errorf("environments should only equal themselves")
+	}
 }
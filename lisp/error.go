@@ -29,3 +29,23 @@ func baseErrorf(format string, a ...interface{}) error {
 	return startStacktrace(stringsToList(
 		strings.Split(fmt.Sprintf(format, a...), " ")...))
 }
+
+// errorList returns err as an l1 error list, wrapping plain Go errors.
+func errorList(err error) *ConsCell {
+	if l, ok := err.(*ConsCell); ok {
+		return l
+	}
+	return baseError(err.Error()).(*ConsCell)
+}
+
+// sameCause reports whether two error lists have the same innermost entry,
+// i.e. whether one is the other with context added.
+func sameCause(a, b *ConsCell) bool {
+	for a.cdr != Nil {
+		a = a.cdr.(*ConsCell)
+	}
+	for b.cdr != Nil {
+		b = b.cdr.(*ConsCell)
+	}
+	return a.car.Equal(b.car)
+}
@@ -6,7 +6,7 @@ import (
 
 func TestConsAsError(t *testing.T) {
 	inner := func() error {
-		return Cons(Atom{"anError"}, Nil)
+		return Cons(Intern("anError"), Nil)
 	}
 	err := inner()
 	if err == nil {
@@ -22,11 +22,11 @@ func TestStackTrace(t *testing.T) {
 		return baseError("innerError")
 	}
 	inner2 := func() error {
-		return extendWithList(list(Atom{"middleError"},
+		return extendWithList(list(Intern("middleError"),
 			stringsToList("with", "some", "extra", "info")), inner1())
 	}
 	inner3 := func() error {
-		return extendWithList(list(Atom{"outerError"}), inner2())
+		return extendWithList(list(Intern("outerError")), inner2())
 	}
 	err := inner3().(*ConsCell)
 	if err == nil {
@@ -36,7 +36,7 @@ func TestStackTrace(t *testing.T) {
 		t.Error("wrong error message:", err.Error())
 	}
 	// Ensure we can pick apart the stacktrace
-	if !err.car.Equal(list(Atom{"outerError"})) {
+	if !err.car.Equal(list(Intern("outerError"))) {
 		t.Error("incorrect car for error message:", err.Error())
 	}
 }
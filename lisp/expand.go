@@ -0,0 +1,277 @@
+package lisp
+
+// Full macro expansion: macroexpandAll expands a form and every form in
+// it which would be evaluated, leaving quoted data and the syntax of
+// special forms (argument lists, binding names, and so on) alone.  Like
+// the compiler, it keeps track of the names bound lexically (see scope),
+// so that a call to a local function which shadows a macro is left
+// unexpanded.
+
+// macroexpandTrace returns a form followed by each successive expansion
+// of it, ending with one which is not a macro call.
+func macroexpandTrace(expr Sexpr, e *Env) ([]Sexpr, error) {
+	ret := []Sexpr{expr}
+	for isMacroCall(expr, e) {
+		var err error
+		expr, err = macroexpand1(expr, e)
+		if err != nil {
+			return nil, extendError("macroexpansion", err)
+		}
+		ret = append(ret, expr)
+	}
+	return ret, nil
+}
+
+func macroexpandAll(expr Sexpr, e *Env) (Sexpr, error) {
+	return expandAll(expr, e, nil)
+}
+
+// expandAll expands expr fully, in the lexical scope s.
+func expandAll(expr Sexpr, e *Env, s *scope) (Sexpr, error) {
+	for isMacroCall(expr, e) && !shadowed(expr, s) {
+		var err error
+		expr, err = macroexpand1(expr, e)
+		if err != nil {
+			return nil, extendError("macroexpansion", err)
+		}
+	}
+	form, ok := expr.(*ConsCell)
+	if !ok || form == Nil {
+		return expr, nil
+	}
+	args, ok := form.cdr.(*ConsCell)
+	if !ok {
+		return expr, nil
+	}
+	var rest Sexpr
+	var err error
+	// Special forms may be protected (see syntaxQuote):
+	head, _ := form.car.(Atom)
+	switch head.global() {
+	case symQuote, symDefsyntax:
+		return form, nil
+	case symSyntaxQuote:
+		rest, err = expandUnquoted(args, 1, e, s)
+	case symCond:
+		rest, err = mapForms(args, 0, func(clause Sexpr) (Sexpr, error) {
+			return expandForms(clause, 0, e, s)
+		})
+	case symLet:
+		rest, err = expandLet(args, e, s, letNames(args.car), func(binding Sexpr) (Sexpr, error) {
+			return expandForms(binding, 1, e, s)
+		})
+	case symBinding:
+		// Dynamic bindings don't shadow anything lexically:
+		rest, err = expandLet(args, e, s, nil, func(binding Sexpr) (Sexpr, error) {
+			return expandForms(binding, 1, e, s)
+		})
+	case symLetfn:
+		inner := &scope{names: letNames(args.car), parent: s}
+		rest, err = expandLet(args, e, s, inner.names, func(def Sexpr) (Sexpr, error) {
+			return expandLambda(def, e, inner)
+		})
+	case symLambda:
+		rest, err = expandLambda(args, e, s)
+	case symDefn, symDefmacro:
+		// The name is defined globally, rather than bound in the body:
+		if args == Nil {
+			return form, nil
+		}
+		fn, err := expandLambda(args.cdr, e, s)
+		if err != nil {
+			return nil, err
+		}
+		rest = Cons(args.car, fn)
+	case symDefmethod:
+		parts, ok := args.cdr.(*ConsCell)
+		if !ok || parts == Nil {
+			return form, nil
+		}
+		value, err := expandAll(parts.car, e, s)
+		if err != nil {
+			return nil, err
+		}
+		fn, err := expandLambda(parts.cdr, e, s)
+		if err != nil {
+			return nil, err
+		}
+		rest = Cons(args.car, Cons(value, fn))
+	case symDef, symDefvar, symSet, symBlock, symReturnFrom:
+		rest, err = expandForms(args, 1, e, s)
+	case symTry:
+		rest, err = mapForms(args, 0, func(x Sexpr) (Sexpr, error) {
+			if c, ok := x.(*ConsCell); ok && listStartsWith(c, symCatch) {
+				inner := s
+				if d, ok := c.cdr.(*ConsCell); ok && d != Nil {
+					if name, ok := d.car.(Atom); ok {
+						inner = &scope{names: []Atom{name}, parent: s}
+					}
+				}
+				return expandForms(c, 2, e, inner)
+			}
+			if c, ok := x.(*ConsCell); ok && listStartsWith(c, symFinally) {
+				return expandForms(c, 1, e, s)
+			}
+			return expandAll(x, e, s)
+		})
+	default:
+		// Other special forms, and function calls, evaluate all their
+		// arguments; the function itself may be a lambda expression:
+		return expandForms(form, 0, e, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Cons(form.car, rest), nil
+}
+
+// shadowed reports whether x is a call to a function bound in s, whose
+// name therefore doesn't refer to any global macro.
+func shadowed(x Sexpr, s *scope) bool {
+	c, ok := x.(*ConsCell)
+	if !ok || c == Nil {
+		return false
+	}
+	head, ok := c.car.(Atom)
+	return ok && s.binds(head)
+}
+
+// letNames returns the names bound by a list of let bindings or letfn
+// definitions, ignoring any which are malformed.
+func letNames(bindings Sexpr) []Atom {
+	xs, err := consToExprs(bindings)
+	if err != nil {
+		return nil
+	}
+	names := []Atom{}
+	for _, x := range xs {
+		if c, ok := x.(*ConsCell); ok && c != Nil {
+			if bound, err := bindingNames(c.car); err == nil {
+				names = append(names, bound...)
+			}
+		}
+	}
+	return names
+}
+
+// argNames returns the names bound by a lambda's argument list, ignoring
+// it if it is malformed.
+func argNames(argList Sexpr) []Atom {
+	fn, err := mkArity(noName, Cons(argList, Nil), false)
+	if err != nil {
+		return nil
+	}
+	return fn.slotNames()
+}
+
+// expandForms expands the elements of a list after the first skip of
+// them.  Anything other than a proper list is returned unchanged.
+func expandForms(x Sexpr, skip int, e *Env, s *scope) (Sexpr, error) {
+	return mapForms(x, skip, func(y Sexpr) (Sexpr, error) {
+		return expandAll(y, e, s)
+	})
+}
+
+// mapForms applies f to the elements of a list after the first skip of
+// them.  Anything other than a proper list is returned unchanged.
+func mapForms(x Sexpr, skip int, f func(Sexpr) (Sexpr, error)) (Sexpr, error) {
+	xs, err := consToExprs(x)
+	if err != nil {
+		return x, nil
+	}
+	ret := make([]Sexpr, len(xs))
+	for i, y := range xs {
+		if i < skip {
+			ret[i] = y
+			continue
+		}
+		if ret[i], err = f(y); err != nil {
+			return nil, err
+		}
+	}
+	return list(ret...), nil
+}
+
+// expandLet expands the bindings of a let-like form with f, and its body
+// in a scope where names are bound.
+func expandLet(args *ConsCell, e *Env, s *scope, names []Atom, f func(Sexpr) (Sexpr, error)) (Sexpr, error) {
+	if args == Nil {
+		return args, nil
+	}
+	bindings, err := mapForms(args.car, 0, f)
+	if err != nil {
+		return nil, err
+	}
+	body, err := expandForms(args.cdr, 0, e, &scope{names: names, parent: s})
+	if err != nil {
+		return nil, err
+	}
+	return Cons(bindings, body), nil
+}
+
+// expandLambda expands the body, or bodies, following a lambda's optional
+// name, in a scope where the name and arguments are bound.  Argument
+// lists and doc forms are left as they are.
+func expandLambda(x Sexpr, e *Env, s *scope) (Sexpr, error) {
+	args, ok := x.(*ConsCell)
+	if !ok || args == Nil {
+		return x, nil
+	}
+	if name, ok := args.car.(Atom); ok && name != symArities {
+		rest, err := expandLambda(args.cdr, e, &scope{names: []Atom{name}, parent: s})
+		if err != nil {
+			return nil, err
+		}
+		return Cons(name, rest), nil
+	}
+	body := func(x Sexpr) (Sexpr, error) {
+		c, ok := x.(*ConsCell)
+		if !ok || c == Nil {
+			return x, nil
+		}
+		skip := 1
+		if d, ok := c.cdr.(*ConsCell); ok && d != Nil {
+			if doc, ok := d.car.(*ConsCell); ok && listStartsWith(doc, symDoc) {
+				skip = 2
+			}
+		}
+		return expandForms(c, skip, e, &scope{names: argNames(c.car), parent: s})
+	}
+	if args.car == symArities {
+		skip := 1
+		if d, ok := args.cdr.(*ConsCell); ok && d != Nil {
+			if doc, ok := d.car.(*ConsCell); ok && listStartsWith(doc, symDoc) {
+				skip = 2
+			}
+		}
+		return mapForms(args, skip, body)
+	}
+	return body(args)
+}
+
+// expandUnquoted expands the forms in a syntax-quoted template which are
+// unquoted at the given depth of nested syntax-quotes.
+func expandUnquoted(x Sexpr, depth int, e *Env, s *scope) (Sexpr, error) {
+	c, ok := x.(*ConsCell)
+	if !ok || c == Nil {
+		return x, nil
+	}
+	switch {
+	case listStartsWith(c, symUnquote) || listStartsWith(c, symSplicing):
+		if depth == 1 {
+			return expandForms(c, 1, e, s)
+		}
+		depth--
+	case listStartsWith(c, symSyntaxQuote):
+		depth++
+	}
+	car, err := expandUnquoted(c.car, depth, e, s)
+	if err != nil {
+		return nil, err
+	}
+	cdr, err := expandUnquoted(c.cdr, depth, e, s)
+	if err != nil {
+		return nil, err
+	}
+	return Cons(car, cdr), nil
+}
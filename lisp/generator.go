@@ -0,0 +1,134 @@
+package lisp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// generator runs a body of code which can pause, with yield, and be resumed
+// with next.  The body runs in a VM of its own, which is simply left as it
+// is while the generator is paused, so that handlers set up by try, and so
+// on, are still in place when it resumes.
+type generator struct {
+	fn  Sexpr
+	env *Env
+	// The VM running the body, once it has started:
+	m *vm
+	// Whether the yield the body is paused at was a tail call:
+	tail bool
+	// The bindings the body made which were in force when it yielded, to
+	// be put back in force when it resumes:
+	dyn []dynBinding
+	// Guards running and done, as goroutines may share a generator:
+	mu      sync.Mutex
+	running bool
+	done    bool
+}
+
+// genYield is returned, in place of an error, by yield.  It stops the
+// generator's VM, which can later be resumed where it left off.
+type genYield struct {
+	val Sexpr
+}
+
+func (gy *genYield) Error() string {
+	return fmt.Sprintf("yield of %s", gy.val)
+}
+
+func (g *generator) String() string {
+	return "<generator>"
+}
+
+func (g *generator) Equal(o Sexpr) bool {
+	return g == o
+}
+
+// resume runs the generator's body, on the thread of e (see threadOf), until
+// it yields, returning the value yielded, or until it finishes, returning
+// ().  Bindings the body makes are only in force while it runs.  x becomes the value of the yield the body is paused at, if any.
+func (g *generator) resume(x Sexpr, e *Env) (Sexpr, error) {
+	g.mu.Lock()
+	switch {
+	case g.done:
+		g.mu.Unlock()
+		return Nil, nil
+	case g.running:
+		g.mu.Unlock()
+		return nil, baseError("generator is already running")
+	}
+	g.running = true
+	g.mu.Unlock()
+	switch {
+	case g.m == nil:
+		c := &code{
+			instrs: []instr{{opCall, 0}, {opReturn, 0}},
+			calls:  []callSite{{nargs: 0}},
+		}
+		g.m = &vm{
+			frames: []frame{{code: c, env: g.env}},
+			nested: true,
+			gen:    g,
+		}
+		g.m.push(g.fn)
+	case g.tail:
+		g.m.ret(x)
+	default:
+		g.m.push(x)
+	}
+	th := threadOf(e)
+	n := len(th.dyn)
+	th.dyn = append(th.dyn, g.dyn...)
+	_, err := th.run(g.m)
+	y, yielded := err.(*genYield)
+	if yielded {
+		g.dyn = append(g.dyn[:0], th.dyn[n:]...)
+	}
+	th.dyn = th.dyn[:n]
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.running = false
+	if yielded {
+		return y.val, nil
+	}
+	g.done, g.m, g.dyn = true, nil, nil
+	if err != nil {
+		return nil, extendError("generator", err)
+	}
+	return Nil, nil
+}
+
+// finished reports whether the generator's body has finished.
+func (g *generator) finished() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
+
+// yieldCtl pauses the generator whose body is running, passing its
+// argument, if any, back to next.
+func yieldCtl(m *vm, base int, tail bool) error {
+	if m.gen == nil {
+		return baseError("yield outside of a generator")
+	}
+	args := m.stack[base+1:]
+	if len(args) > 1 {
+		return baseError("yield takes at most one argument")
+	}
+	var val Sexpr = Nil
+	if len(args) == 1 {
+		val = args[0]
+	}
+	m.stack = m.stack[:base]
+	m.gen.tail = tail
+	return &genYield{val}
+}
+
+// mkGenerator is called by the code compiled for the generator form, with
+// a function of no arguments wrapping its body.
+var mkGenerator = &Builtin{
+	Name:       "generator",
+	FixedArity: 1,
+	Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+		return &generator{fn: args[0], env: e}, nil
+	},
+}
@@ -2,54 +2,182 @@ package lisp
 
 import (
 	"fmt"
+	"strings"
 )
 
 type lambdaFn struct {
-	args    *ConsCell
-	restArg string
-	body    *ConsCell
-	doc     *ConsCell
-	isMacro bool
-	env     *Env
+	name Atom
+	// The name the function was defined with by `defn` or `letfn`, if
+	// any, for error messages:
+	defName Atom
+	// Required arguments, which may be patterns (see destructure.go):
+	args *ConsCell
+	// The patterns among the required arguments:
+	patterns []patternArg
+	// Arguments following &optional and &key:
+	optionals []param
+	keys      []param
+	restArg   Atom
+	body      *ConsCell
+	doc       *ConsCell
+	isMacro   bool
+	env       *Env
+	// The compiled body; set when the lambda expression is compiled.
+	code *code
+	// For functions with one body per argument count, the bodies, each
+	// with its own argument list; the function itself then has no body.
+	arities []*lambdaFn
 }
 
-var noRestArg string = ""
+// param is an &optional or &key argument, with its default value (an
+// expression), if it has one.
+type param struct {
+	name Atom
+	dflt Sexpr
+}
 
-func mkLambda(cdr *ConsCell, isMacro bool, e *Env) (*lambdaFn, error) {
-	restArg := noRestArg
+// patternArg is a required argument given as a pattern.  The argument
+// is bound to a hidden name, then destructured into the pattern's names.
+type patternArg struct {
+	hidden  Atom
+	pattern *ConsCell
+	names   []Atom
+}
+
+// Unnamed lambdas, and those without rest arguments, have these in place of
+// atoms:
+var noName, noRestArg Atom
+
+var (
+	symOptional = Intern("&optional")
+	symKey      = Intern("&key")
+	symArities  = Intern("&arities")
+	symDoc      = Intern("doc")
+)
+
+// mkLambda parses the argument list and body of a lambda expression.  The
+// result has no environment yet; see closure().
+func mkLambda(cdr *ConsCell, isMacro bool) (*lambdaFn, error) {
 	// look for fn name
 	if cdr == Nil {
 		return nil, baseError("missing arguments")
 	}
 	fnNameAtom, ok := cdr.car.(Atom)
-	var fnName string
-	if ok {
-		fnName = fnNameAtom.s
+	fnName := noName
+	if ok && fnNameAtom != symArities {
+		fnName = fnNameAtom
 		cdr = cdr.cdr.(*ConsCell)
 	}
 	if cdr == Nil {
 		return nil, baseError("missing arguments")
 	}
+	if cdr.car == symArities {
+		clauses, doc, err := arityClauses(cdr.cdr)
+		if err != nil {
+			return nil, err
+		}
+		fn := &lambdaFn{name: fnName, doc: doc, isMacro: isMacro}
+		for _, clause := range clauses {
+			arity, err := mkArity(fnName, clause.(*ConsCell), isMacro)
+			if err != nil {
+				return nil, err
+			}
+			fn.arities = append(fn.arities, arity)
+		}
+		return fn, nil
+	}
+	return mkArity(fnName, cdr, isMacro)
+}
+
+// arityClauses returns the clauses of a lambda with one body per argument
+// count, and its doc form, if any, given what follows &arities, e.g. for
+//
+//	(lambda &arities (doc ...) ((x) ...) ((x y) ...))
+//
+// Each clause is a list whose car is an argument list.
+func arityClauses(x Sexpr) ([]Sexpr, *ConsCell, error) {
+	forms, err := consToExprs(x)
+	if err != nil {
+		return nil, nil, baseError("&arities must be followed by a list of clauses")
+	}
+	doc := Nil
+	if len(forms) > 0 {
+		if d, ok := forms[0].(*ConsCell); ok && listStartsWith(d, symDoc) {
+			doc = d.cdr.(*ConsCell)
+			forms = forms[1:]
+		}
+	}
+	if len(forms) == 0 {
+		return nil, nil, baseError("&arities requires at least one clause")
+	}
+	for _, x := range forms {
+		if c, ok := x.(*ConsCell); !ok || c == Nil {
+			return nil, nil, baseErrorf("arity clause %s must be an argument list and a body", x)
+		}
+	}
+	return forms, doc, nil
+}
+
+// mkArity parses a single argument list and body.
+func mkArity(fnName Atom, cdr *ConsCell, isMacro bool) (*lambdaFn, error) {
+	restArg := noRestArg
 	argList, ok := cdr.car.(*ConsCell)
 	if !ok {
 		return nil, baseError("lambda requires an argument list")
 	}
 	emptyArgList := false
-	args := []string{}
+	args := []Sexpr{}
+	var optionals, keys []param
+	var patterns []patternArg
+	// Which kind of argument comes next: &optional, &key, or (noName)
+	// required:
+	kind := noName
 top:
 	for argList != Nil && !emptyArgList {
-		if argList.car == Nil {
-			emptyArgList = true
-		} else {
-			arg, ok := argList.car.(Atom)
-			if !ok {
-				return nil, baseError("argument list item is not an atom")
+		switch arg := argList.car.(type) {
+		case Atom:
+			switch {
+			case arg == symOptional || arg == symKey:
+				if kind == symKey || kind == arg {
+					return nil, baseErrorf("misplaced %s in argument list", arg)
+				}
+				kind = arg
+			case kind == symOptional:
+				optionals = append(optionals, param{name: arg})
+			case kind == symKey:
+				keys = append(keys, param{name: arg})
+			default:
+				args = append(args, arg)
+			}
+		case *ConsCell:
+			if arg == Nil && kind == noName {
+				emptyArgList = true
+				break
+			}
+			if kind == noName {
+				names, err := patternNames(arg)
+				if err != nil {
+					return nil, err
+				}
+				patterns = append(patterns, patternArg{gensym("-arg"), arg, names})
+				args = append(args, arg)
+				break
+			}
+			p, err := mkParam(kind, arg)
+			if err != nil {
+				return nil, err
 			}
-			args = append(args, arg.s)
+			if kind == symOptional {
+				optionals = append(optionals, p)
+			} else {
+				keys = append(keys, p)
+			}
+		default:
+			return nil, baseError("argument list item is not an atom")
 		}
 		switch t := argList.cdr.(type) {
 		case Atom:
-			restArg = t.s
+			restArg = t
 			break top
 		case *ConsCell:
 			argList = t
@@ -65,7 +193,7 @@ top:
 	doc := Nil
 	if body != Nil && body.car != Nil {
 		doc2, ok := body.car.(*ConsCell)
-		if ok && doc2 != Nil && doc2.car.Equal(Atom{"doc"}) {
+		if ok && doc2 != Nil && doc2.car.Equal(symDoc) {
 			cdrCons, ok := doc2.cdr.(*ConsCell)
 			if !ok {
 				return nil, baseError("doc form is not a list")
@@ -77,31 +205,176 @@ top:
 			body = body.cdr.(*ConsCell) // Skip `doc` part.
 		}
 	}
-	f := lambdaFn{
-		stringsToList(args...),
-		restArg,
-		body,
-		doc,
-		isMacro,
-		e}
-	if fnName != "" {
-		// Monkey-patch the environment the lambda is created in, so the
-		// lambda can invoke itself if the name is available:
-		e.Set(fnName, &f)
+	return &lambdaFn{
+		name:      fnName,
+		args:      list(args...),
+		patterns:  patterns,
+		optionals: optionals,
+		keys:      keys,
+		restArg:   restArg,
+		body:      body,
+		doc:       doc,
+		isMacro:   isMacro,
+	}, nil
+}
+
+// mkParam parses an (name default) pair following &optional or &key.
+func mkParam(kind Atom, x *ConsCell) (param, error) {
+	if kind == noName {
+		return param{}, baseError("argument list item is not an atom")
+	}
+	name, ok := x.car.(Atom)
+	if !ok {
+		return param{}, baseErrorf("%s argument name is not an atom", kind)
+	}
+	dflt, ok := x.cdr.(*ConsCell)
+	if !ok || dflt == Nil || dflt.cdr != Nil {
+		return param{}, baseErrorf("%s argument must be a name or a (name default) pair", kind)
 	}
-	return &f, nil
+	return param{name, dflt.car}, nil
 }
 
-func (f *lambdaFn) String() string {
-	restArgsRepr := ""
+// slotNames returns the names of the slots a lambda's arguments occupy in
+// its environment: required arguments (or, for patterns, their hidden
+// names), then &optional and &key arguments, then any rest argument, then
+// the names in any patterns.
+func (f *lambdaFn) slotNames() []Atom {
+	names := []Atom{}
+	patterns := f.patterns
+	for args := f.args; args != Nil; args = args.cdr.(*ConsCell) {
+		if name, ok := args.car.(Atom); ok {
+			names = append(names, name)
+		} else {
+			names = append(names, patterns[0].hidden)
+			patterns = patterns[1:]
+		}
+	}
+	for _, p := range f.optionals {
+		names = append(names, p.name)
+	}
+	for _, p := range f.keys {
+		names = append(names, p.name)
+	}
 	if f.restArg != noRestArg {
-		restArgsRepr = fmt.Sprintf(" . %s", f.restArg)
+		names = append(names, f.restArg)
+	}
+	for _, p := range f.patterns {
+		names = append(names, p.names...)
+	}
+	return names
+}
+
+// params returns the argument list of a lambda, as it would be written.
+// For a lambda with several arities, it returns the list of argument lists.
+func (f *lambdaFn) params() *ConsCell {
+	if f.arities != nil {
+		ret := []Sexpr{}
+		for _, arity := range f.arities {
+			ret = append(ret, arity.params())
+		}
+		return list(ret...)
+	}
+	ret := []Sexpr{}
+	for args := f.args; args != Nil; args = args.cdr.(*ConsCell) {
+		ret = append(ret, args.car)
+	}
+	for _, section := range []struct {
+		kind   Atom
+		params []param
+	}{{symOptional, f.optionals}, {symKey, f.keys}} {
+		if len(section.params) > 0 {
+			ret = append(ret, section.kind)
+		}
+		for _, p := range section.params {
+			if p.dflt == nil {
+				ret = append(ret, p.name)
+			} else {
+				ret = append(ret, list(p.name, p.dflt))
+			}
+		}
+	}
+	return combineArgs(list(ret...), restOrNil(f.restArg))
+}
+
+func restOrNil(restArg Atom) Sexpr {
+	if restArg == noRestArg {
+		return Nil
+	}
+	return restArg
+}
+
+// source returns the lambda expression the function was made from.
+func (f *lambdaFn) source() *ConsCell {
+	if f.arities != nil {
+		clauses := Nil
+		for i := len(f.arities) - 1; i >= 0; i-- {
+			clauses = Cons(f.arities[i].source().cdr, clauses)
+		}
+		return Cons(Intern("lambda"), Cons(symArities, clauses))
 	}
-	return fmt.Sprintf("<lambda(%s%s)>",
-		unwrapList(f.args),
-		restArgsRepr)
+	return Cons(Intern("lambda"), Cons(f.params(), f.body))
+}
+
+// argCounts returns the fewest and most arguments the function accepts;
+// the most is -1 if there is no limit, i.e. if the function (or one of its
+// arities) has a rest or &key argument.
+func (f *lambdaFn) argCounts() (int, int) {
+	if f.arities != nil {
+		min, max := -1, 0
+		for _, arity := range f.arities {
+			lo, hi := arity.argCounts()
+			if min < 0 || lo < min {
+				min = lo
+			}
+			if max >= 0 && (hi < 0 || hi > max) {
+				max = hi
+			}
+		}
+		return min, max
+	}
+	n, _ := consLength(f.args)
+	if len(f.keys) > 0 || f.restArg != noRestArg {
+		return n, -1
+	}
+	return n, n + len(f.optionals)
+}
+
+// signature describes how a function is called, for error messages,
+// e.g. (f x &optional y), or (lambda (x &optional y)) if it has no name.
+func (f *lambdaFn) signature() Sexpr {
+	switch {
+	case f.defName != noName:
+		return combineArgs(Cons(f.defName, Nil), f.params())
+	case f.name != noName:
+		return combineArgs(Cons(f.name, Nil), f.params())
+	}
+	return list(Intern("lambda"), f.params())
+}
+
+// arity returns the position among its arities of the body of the function
+// to run for n arguments, or -1 if there is none.
+func (f *lambdaFn) arity(n int) int {
+	for i, arity := range f.arities {
+		if min, max := arity.argCounts(); n >= min && (n <= max || max < 0) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *lambdaFn) String() string {
+	if f.arities != nil {
+		return fmt.Sprintf("<lambda%s>", f.params())
+	}
+	return fmt.Sprintf("<lambda(%s)>", unwrapList(f.params()))
 }
 
 func (f *lambdaFn) Equal(o Sexpr) bool {
 	return false
 }
+
+// isKeyword reports whether an atom is a keyword, such as :name, which
+// evaluates to itself.
+func isKeyword(a Atom) bool {
+	return len(a.s) > 1 && strings.HasPrefix(a.s, ":")
+}
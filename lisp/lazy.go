@@ -0,0 +1,160 @@
+package lisp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// delay puts off evaluating some code, made with the delay form.  The
+// code runs the first time the delay is forced, and its value is kept for
+// later forcing.  A lazy sequence is a list whose tail is a delay (see
+// lazy-cons in l1.l1); cdr, len, printing and so on force such tails as
+// they reach them.
+type delay struct {
+	mu   sync.Mutex
+	fn   Sexpr
+	env  *Env
+	val  Sexpr
+	done bool
+	// While the delay is being forced, the thread forcing it, and a
+	// channel closed once it has finished, for which other threads
+	// forcing it wait:
+	forcing  *thread
+	finished chan struct{}
+}
+
+// PrintLength is the number of elements of a lazy sequence which are
+// printed; any further ones are shown as "...".
+var PrintLength = 100
+
+func (d *delay) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.done {
+		return "<delay>"
+	}
+	return fmt.Sprintf("<delay: %s>", d.val)
+}
+
+func (d *delay) Equal(o Sexpr) bool {
+	return d == o
+}
+
+// force evaluates the delayed code, if that has not already been done, and
+// returns its value.  If the code raises an error, the next force tries
+// again.  The code runs on the thread of e, the environment handed to the
+// builtin forcing the delay, if any (see threadOf).  Other threads forcing
+// the delay meanwhile wait for it (see limits.wait); the code itself
+// forcing it is an error, as is forcing it meanwhile on behalf of no thread
+// in particular (e.g. in ConsCell.Equal), since that may be the code
+// itself.
+func (d *delay) force(e *Env) (Sexpr, error) {
+	th := threadOf(e)
+	d.mu.Lock()
+	for d.forcing != nil {
+		if d.forcing == th || e == nil {
+			d.mu.Unlock()
+			return nil, baseError("delay forced recursively")
+		}
+		finished := d.finished
+		d.mu.Unlock()
+		if err := threadOf(e).lim.wait(finished); err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+	}
+	if d.done {
+		d.mu.Unlock()
+		return d.val, nil
+	}
+	d.forcing, d.finished = th, make(chan struct{})
+	d.mu.Unlock()
+	val, err := th.call(d.fn, nil, d.env)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.finished)
+	d.forcing, d.finished = nil, nil
+	if err != nil {
+		return nil, err
+	}
+	d.val, d.done = val, true
+	d.fn, d.env = nil, nil
+	return val, nil
+}
+
+// forceTail returns the list a lazy sequence's tail stands for, forcing it
+// (and any delay it returns) on behalf of e if need be (see delay.force).
+// Anything else is returned as is.
+func forceTail(x Sexpr, e *Env) (Sexpr, error) {
+	for {
+		d, ok := x.(*delay)
+		if !ok {
+			return x, nil
+		}
+		var err error
+		if x, err = d.force(e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// forcedTail is like forceTail, but never forces a delay, reporting
+// instead whether the tail has been forced already.
+func forcedTail(x Sexpr) (Sexpr, bool) {
+	for {
+		d, ok := x.(*delay)
+		if !ok {
+			return x, true
+		}
+		d.mu.Lock()
+		x, ok = d.val, d.done
+		d.mu.Unlock()
+		if !ok {
+			return nil, false
+		}
+	}
+}
+
+// isLazy returns true for a lazy sequence, i.e., a list whose first tail
+// is a delay.
+func isLazy(x Sexpr) bool {
+	c, ok := x.(*ConsCell)
+	if !ok || c == Nil {
+		return false
+	}
+	_, ok = c.cdr.(*delay)
+	return ok
+}
+
+// forcePrinted forces as much of a lazy sequence, or of any lazy sequences
+// in a list, as will be printed (see ConsCell.String), on behalf of e,
+// returning any error raised in doing so.
+func forcePrinted(x Sexpr, e *Env) error {
+	lazy := false
+	for n := 0; ; n++ {
+		c, ok := x.(*ConsCell)
+		if !ok || c == Nil || (lazy && n >= PrintLength) {
+			return nil
+		}
+		if err := forcePrinted(c.car, e); err != nil {
+			return err
+		}
+		if _, ok := c.cdr.(*delay); ok {
+			lazy = true
+		}
+		var err error
+		if x, err = forceTail(c.cdr, e); err != nil {
+			return err
+		}
+	}
+}
+
+// mkDelay is called by the code compiled for the delay form, with a
+// function of no arguments wrapping its body.
+var mkDelay = &Builtin{
+	Name:       "delay",
+	FixedArity: 1,
+	Fn: func(args []Sexpr, e *Env) (Sexpr, error) {
+		return &delay{fn: args[0], env: e}, nil
+	},
+}
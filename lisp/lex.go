@@ -121,6 +121,14 @@ func lexStart(l *lexutil.Lexer) lexutil.StateFn {
 			l.Backup()
 			return lexUnquote
 		case r == '.':
+			// The ellipsis, ..., used in defsyntax, is an atom:
+			if l.Accept(".") {
+				if !l.Accept(".") {
+					return l.Errorf("unexpected '..' in input", itemError)
+				}
+				l.Emit(itemAtom)
+				break
+			}
 			l.Emit(itemDot)
 		case r == '#':
 			l.Backup()
@@ -157,6 +165,8 @@ func lexAtom(l *lexutil.Lexer) lexutil.StateFn {
 	acceptIf(l, func(r rune) bool {
 		return !(strings.ContainsRune(disallowedForAtomAfterStart, r))
 	})
+	// A trailing # marks an auto-gensym, e.g. x#, in a syntax-quoted form:
+	l.Accept("#")
 	l.Emit(itemAtom)
 	return lexStart
 }
@@ -106,6 +106,9 @@ func TestLex(t *testing.T) {
 			Err("unexpected character '@' in input", 3),
 			N("3", 4),
 			RP(")", 4))},
+		{S("`(a# ~b)"), toks(BACKQUOTE("`", 1), LP("(", 1),
+			A("a#", 1), UNQUOTE("~", 1), A("b", 1), RP(")", 1))},
+		{S("(a ...)"), toks(LP("(", 1), A("a", 1), A("...", 1), RP(")", 1))},
 		{S("#_1"), toks(COMMENTNEXT("#_", 1), N("1", 1))},
 		{S("#_(1 2 3)"), toks(COMMENTNEXT("#_", 1), LP("(", 1), N("1", 1), N("2", 1), N("3", 1), RP(")", 1))},
 		{S("#!/bin/bash\n1(+)\n"), toks(SHEBANG("#!/bin/bash", 1),
@@ -0,0 +1,117 @@
+package lisp
+
+import (
+	"context"
+	"sync"
+)
+
+// Once an evaluation is stopped, cleanup code (`finally`, `unwind-protect`)
+// on the way out may run for this many more steps:
+const cleanupSteps = 100000
+
+// How many steps to run between checks of the context:
+const ctxCheckInterval = 1024
+
+// limits bounds an evaluation (see EvalExprsContext).  Every VM running on
+// behalf of the evaluation, including those started by builtins, shares the
+// same limits via its thread; so do the threads forked from it for
+// goroutines started by spawn, hence the mutex.
+type limits struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	maxSteps int // 0 means no limit
+	steps    int
+	// Set once the evaluation has been stopped:
+	err   error
+	grace int
+}
+
+// step counts an evaluation step, returning an error if the evaluation must
+// stop.
+func (l *limits) step() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.steps++
+	if l.err != nil {
+		if l.steps > l.grace {
+			return l.err
+		}
+		return nil
+	}
+	if l.maxSteps > 0 && l.steps > l.maxSteps {
+		return l.stop("step limit exceeded")
+	}
+	if l.steps%ctxCheckInterval == 0 && l.ctx.Err() != nil {
+		return l.stop("evaluation cancelled")
+	}
+	return nil
+}
+
+func (l *limits) stop(msg string) error {
+	l.err = baseError(msg)
+	l.grace = l.steps + cleanupSteps
+	return l.err
+}
+
+// cancelled returns a channel which is closed once the evaluation's context
+// is, for operations which may block to wait on as well; nil, which never
+// is, without limits.
+func (l *limits) cancelled() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.ctx.Done()
+}
+
+// block counts an operation which may block (see cancelled) as a step,
+// returning an error if the evaluation has been stopped, as it is once its
+// context is cancelled: cleanup code may not wait.
+func (l *limits) block() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.step(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil && l.ctx.Err() != nil {
+		l.stop("evaluation cancelled")
+	}
+	return l.err
+}
+
+// wait waits for done to be closed, or for the evaluation to be stopped.
+func (l *limits) wait(done <-chan struct{}) error {
+	if err := l.block(); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-l.cancelled():
+		return l.block()
+	}
+}
+
+// stopping reports whether the evaluation has been stopped, in which case
+// errors can no longer be caught.
+func (l *limits) stopping() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err != nil
+}
+
+// limitedThread returns a new thread for an evaluation with the given
+// limits.  Without a deadline, cancellation or step budget, no limits are
+// imposed.
+func limitedThread(ctx context.Context, maxSteps int) *thread {
+	th := &thread{}
+	if ctx.Done() != nil || maxSteps > 0 {
+		th.lim = &limits{ctx: ctx, maxSteps: maxSteps}
+	}
+	return th
+}
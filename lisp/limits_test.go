@@ -0,0 +1,122 @@
+package lisp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore, &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := MaxRecursionDepth
+	MaxRecursionDepth = 100000
+	defer func() { MaxRecursionDepth = saved }()
+	bg := context.Background()
+	cancelled, cancel := context.WithCancel(bg)
+	cancel()
+	timedOut, cancel := context.WithTimeout(bg, 10*time.Millisecond)
+	defer cancel()
+	var tests = []struct {
+		ctx      context.Context
+		maxSteps int
+		in       string
+		err      string
+	}{
+		{bg, 1000, "(+ 1 1)", ""},
+		{bg, 1000, "(loop)", "(step limit exceeded)"},
+		{cancelled, 0, "(loop)", "(evaluation cancelled)"},
+		{timedOut, 0, "(loop)", "(evaluation cancelled)"},
+		// Functions called from builtins count too:
+		{bg, 1000, "(map (lambda (x) (loop)) '(1))", "(step limit exceeded)"},
+		// ... including in other top-level environments:
+		{bg, 1000, "(eval '(sort-by (lambda (x) (loop)) '(1 2)) (make-env))", "(step limit exceeded)"},
+		// ... as does comparing lazy sequences:
+		{bg, 1000, "(= (range) (range))", "(step limit exceeded)"},
+		{timedOut, 0, "(= (range) (range))", "(evaluation cancelled)"},
+		// Stopped evaluations can't be caught:
+		{bg, 1000, "(loop (swallow (loop)))", "(step limit exceeded)"},
+		{bg, 1000, "(try (loop) (catch e e))", "(step limit exceeded)"},
+		// ... but cleanup code runs, without replacing the error:
+		{bg, 1000, "(unwind-protect (loop) (def cleaned t))", "(step limit exceeded)"},
+		{bg, 1000, "cleaned", ""},
+		{bg, 1000, "(unwind-protect (loop) (error '(oops)))", "(step limit exceeded)"},
+		{bg, 1000, "(unwind-protect (loop) (loop))", "(step limit exceeded)"},
+		// Waiting on channels stops too, rather than blocking forever:
+		{timedOut, 0, "(recv (chan))", "(evaluation cancelled)"},
+		{timedOut, 0, "(send (chan) 1)", "(evaluation cancelled)"},
+		{timedOut, 0, "(select (recv (chan) x x))", "(evaluation cancelled)"},
+		{cancelled, 0, "(recv (chan 1))", "(evaluation cancelled)"},
+		{bg, 1000, "(unwind-protect (loop) (recv (chan)))", "(step limit exceeded)"},
+		{timedOut, 0, "(try (recv (chan)) (catch e e))", "(evaluation cancelled)"},
+		// ... as does waiting on tasks, futures and promises:
+		{timedOut, 0, "(join (spawn recv (chan)))", "(evaluation cancelled)"},
+		{timedOut, 0, "(deref (future (recv (chan))))", "(evaluation cancelled)"},
+		{timedOut, 0, "(deref (promise))", "(evaluation cancelled)"},
+		{timedOut, 0, "(let ((d (delay (recv (chan))))) (spawn force d) (force d))", "(evaluation cancelled)"},
+		{bg, 1000, "(unwind-protect (loop) (deref (promise)))", "(step limit exceeded)"},
+		// Calls in VMs nested by builtins count towards the maximum
+		// recursion depth, rather than overflowing the Go stack:
+		{bg, 0, "(defn g (n) (if (zero? n) 0 (+ 1 (force (delay (g (- n 1)))))))", ""},
+		{bg, 0, "(g 10000000)", "(maximum recursion depth exceeded)"},
+		{bg, 0, "(g 1000)", ""},
+		{bg, 0, "(defmacro mm (n) (if (zero? n) 0 (eval (list 'mm (- n 1)))))", ""},
+		{bg, 0, "(mm 10000000)", "(maximum recursion depth exceeded)"},
+	}
+	for _, test := range tests {
+		err := LexParseEvalContext(test.ctx, test.in, &globals, test.maxSteps)
+		switch {
+		case err == nil && test.err != "":
+			t.Errorf("%s: expected error %q, got none", test.in, test.err)
+		case err != nil && (test.err == "" || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %q, want %q", test.in, err, test.err)
+		}
+	}
+	// Limits only apply during the limited evaluation:
+	if err := LexParseEval("(len (range 10000))", &globals); err != nil {
+		t.Errorf("limits still in force after evaluation: %s", err)
+	}
+}
+
+// Evaluations sharing a top-level environment at the same time each have
+// their own limits.
+func TestConcurrentLimits(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore+"(def ch (chan))", &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		maxSteps int
+		in       string
+		err      string
+	}{
+		{1000, "(send ch 1) (send ch 2) (loop)", "(step limit exceeded)"},
+		{0, "(recv ch) (len (range 50000))", ""},
+		{10000000, "(recv ch) (len (range 50000))", ""},
+	}
+	errs := make([]error, len(tests))
+	var wg sync.WaitGroup
+	for i, test := range tests {
+		wg.Add(1)
+		go func(i int, in string, maxSteps int) {
+			defer wg.Done()
+			errs[i] = LexParseEvalContext(context.Background(), in, &globals, maxSteps)
+		}(i, test.in, test.maxSteps)
+	}
+	wg.Wait()
+	for i, test := range tests {
+		err := errs[i]
+		switch {
+		case err == nil && test.err != "":
+			t.Errorf("%s: expected error %q, got none", test.in, test.err)
+		case err != nil && (test.err == "" || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %q, want %q", test.in, err, test.err)
+		}
+	}
+}
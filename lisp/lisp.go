@@ -1,6 +1,7 @@
 package lisp
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
@@ -13,21 +14,6 @@ type Sexpr interface {
 	Equal(Sexpr) bool
 }
 
-func evAtom(a Atom, e *Env) (Sexpr, error) {
-	if a.s == "t" {
-		return a, nil
-	}
-	ret, ok := e.Lookup(a.s)
-	if ok {
-		return ret, nil
-	}
-	ret, ok = builtins[a.s]
-	if ok {
-		return ret, nil
-	}
-	return nil, baseErrorf("unknown symbol: %s", a.s)
-}
-
 // Do this once, it's pretty expensive:
 var cxrRe = regexp.MustCompile(`^c([ad]+)r$`)
 
@@ -35,181 +21,100 @@ func isCxr(a Atom) bool {
 	return cxrRe.MatchString(a.s) && a.s != "car" && a.s != "cdr"
 }
 
-func extractCxrLambda(t Atom, e *Env) (Sexpr, error) {
+// extractCxrLambda returns a lambda template for a c[ad]+r function.
+func extractCxrLambda(t Atom) *lambdaFn {
 	args := Nil
 	for i := 1; i < len(t.s)-1; i++ {
 		// isCxr guarantees that the string is of the form c[ad]+r, so
 		// runes are either 'a' or 'd', of length 1:
-		args = Cons(Atom{string(t.s[i])}, args)
+		args = Cons(Intern(string(t.s[i])), args)
 	}
-	newLambda := &lambdaFn{
-		args:    list(Atom{"xs"}),
-		body:    list(list(Atom{"c*r"}, list(Atom{"quote"}, args), Atom{"xs"})),
-		isMacro: false,
-		env:     e,
+	return &lambdaFn{
+		args: list(Intern("xs")),
+		body: list(list(Intern("c*r"), list(Intern("quote"), args), Intern("xs"))),
 	}
-	return newLambda, nil
 }
 
-func evDef(args *ConsCell, e *Env) (Sexpr, error) {
-	if args == Nil {
-		return nil, baseError("missing argument")
-	}
-	carAtom, ok := args.car.(Atom)
-	if !ok {
-		return nil, baseError("def: first argument must be an atom")
-	}
-	name := carAtom.s
-	args, ok = args.cdr.(*ConsCell)
-	if !ok || args == Nil {
-		return nil, baseError("missing argument")
-	}
-	val, err := eval(args.car, e)
-	if err != nil {
-		return nil, extendError("evaluating def value", err)
-	}
-	err = e.SetTopLevel(name, val)
-	if err != nil {
-		return nil, extendError("setting def result", err)
-	}
-	return val, nil
-}
-
-func evSet(args *ConsCell, e *Env) (Sexpr, error) {
-	if args == Nil {
-		return nil, baseError("missing argument")
-	}
-	if args.car == Nil {
-		return nil, baseError("set!: first argument cannot be nil!")
-	}
-	carAtom, ok := args.car.(Atom)
-	if !ok {
-		return nil, baseErrorf("set!: first argument must be an atom")
-	}
-	name := carAtom.s
-	args, ok = args.cdr.(*ConsCell)
-	if !ok || args == Nil {
-		return nil, baseError("missing argument")
-	}
-	val, err := eval(args.car, e)
-	if err != nil {
-		return nil, extendError("evaluating set value", err)
-	}
-	err = e.Update(name, val)
+// setLambdaArgs binds a lambda's arguments in the slots of a new
+// environment (see lambdaFn.slotNames).  The slots of &optional and &key
+// arguments not supplied are left empty, for the lambda's code to fill in
+// with their defaults.
+func setLambdaArgs(vals []Sexpr, lambda *lambdaFn, evaledList []Sexpr) error {
+	numArgs, err := consLength(lambda.args)
 	if err != nil {
-		return nil, extendError("updating set result", err)
-	}
-	return val, nil
-}
-
-func evDefn(args *ConsCell, isMacro bool, e *Env) (Sexpr, error) {
-	errPreamble := "defn"
-	if isMacro {
-		errPreamble = "defmacro"
-	}
-
-	if args == Nil {
-		return nil, baseErrorf("%s requires a function name", errPreamble)
-	}
-	name, ok := args.car.(Atom)
-	if !ok {
-		return nil, baseErrorf("%s name must be an atom", errPreamble)
+		return extendError("setting lambda args", err)
 	}
-	args = args.cdr.(*ConsCell)
-	if args == Nil {
-		return nil, baseErrorf("%s requires an argument list", errPreamble)
+	if numArgs > len(evaledList) {
+		return arityError("not enough arguments for", lambda, len(evaledList))
 	}
-	fn, err := mkLambda(args, isMacro, e)
-	if err != nil {
-		return nil, extendError("creating lambda function", err)
+	copy(vals, evaledList[:numArgs])
+	rest := evaledList[numArgs:]
+	n := copy(vals[numArgs:numArgs+len(lambda.optionals)], rest)
+	rest = rest[n:]
+	slot := numArgs + len(lambda.optionals)
+	if len(lambda.keys) > 0 {
+		if err := setKeyArgs(vals[slot:slot+len(lambda.keys)], lambda, rest); err != nil {
+			return err
+		}
+		slot += len(lambda.keys)
+	} else if len(rest) > 0 && lambda.restArg == noRestArg {
+		return arityError("too many arguments for", lambda, len(evaledList))
 	}
-	err = e.SetTopLevel(name.s, fn)
-	if err != nil {
-		return nil, extendError("setting defn result", err)
+	if lambda.restArg != noRestArg {
+		vals[slot] = mkListAsConsWithCdr(rest, Nil)
 	}
-	return Nil, nil
+	return nil
 }
 
-func evErrors(args *ConsCell, e *Env) (Sexpr, error) {
-	if args == Nil {
-		return nil, baseError("no error spec given")
-	}
-	sigExpr, ok := args.car.(*ConsCell)
-	if !ok {
-		return nil, baseError("error signature must be a list")
-	}
-	sigEvaled, err := eval(sigExpr, e)
-	if err != nil {
-		return nil, extendError("evaluating error signature", err)
-	}
-	sigList, ok := sigEvaled.(*ConsCell)
-	if !ok {
-		return nil, baseError("error signature must be a list")
+// setKeyArgs binds &key arguments, given as :name value pairs.  Unknown
+// names are an error, unless the lambda has a rest argument to take them.
+func setKeyArgs(vals []Sexpr, lambda *lambdaFn, pairs []Sexpr) error {
+	if len(pairs)%2 != 0 && lambda.restArg == noRestArg {
+		return extendWithList(list(Intern("calling"), lambda.signature()),
+			baseError("odd number of keyword arguments"))
 	}
-	errorStr := unwrapList(sigList)
-	bodyArgs := args.cdr.(*ConsCell)
-	for {
-		if bodyArgs == Nil {
-			return nil, baseErrorf("error not found in %s", args)
-		}
-		toEval := bodyArgs.car
-		_, err := eval(toEval, e)
-		if err != nil {
-			if strings.Contains(err.Error(), errorStr) {
-				return Nil, nil
+top:
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if kw, ok := pairs[i].(Atom); ok && isKeyword(kw) {
+			for j, p := range lambda.keys {
+				if p.name.s == kw.s[1:] {
+					// The first value given wins:
+					if vals[j] == nil {
+						vals[j] = pairs[i+1]
+					}
+					continue top
+				}
 			}
-			return nil, baseErrorf("error '%s' not found in '%s'",
-				errorStr, err.Error())
-		}
-		bodyArgs = bodyArgs.cdr.(*ConsCell)
-	}
-}
-
-// Both eval, apply and macroexpansion use this to bind lambda arguments in the
-// supplied environment:
-func setLambdaArgsInEnv(e *Env, lambda *lambdaFn, evaledList []Sexpr) error {
-	numArgs, err := consLength(lambda.args)
-	if err != nil {
-		return extendError("setting lambda args", err)
-	}
-	if lambda.restArg != noRestArg {
-		if numArgs > len(evaledList) {
-			return baseError("not enough arguments for function")
 		}
-		err = e.Set(lambda.restArg,
-			mkListAsConsWithCdr(evaledList[numArgs:],
-				Nil))
-		if err != nil {
-			return err
-		}
-	} else {
-		if numArgs < len(evaledList) {
-			return baseError("too many arguments for function")
-		} else if numArgs > len(evaledList) {
-			return baseError("not enough arguments for function")
+		if lambda.restArg == noRestArg {
+			return extendWithList(list(Intern("calling"), lambda.signature()),
+				baseErrorf("unknown keyword argument %s", pairs[i]))
 		}
 	}
-	// // iterate over lambda.args and evaledList, binding each:
-	start := lambda.args
-	i := 0
-	for start != Nil {
-		arg, ok := start.car.(Atom)
-		if !ok {
-			return baseError("lambda argument must be an atom")
-		}
-		err = e.Set(arg.s, evaledList[i])
-		if err != nil {
-			return extendError("setting lambda arg", err)
-		}
-		start, ok = start.cdr.(*ConsCell)
-		if !ok {
-			return baseError("lambda argument list must be a list")
-		}
-		i++
-	}
 	return nil
 }
 
+// arityError reports a call with the wrong number of arguments, giving the
+// function's signature.
+func arityError(msg string, fn *lambdaFn, n int) error {
+	words := []Sexpr{}
+	for _, w := range strings.Split(msg, " ") {
+		words = append(words, Intern(w))
+	}
+	return startStacktrace(mkListAsConsWithCdr(append(words, fn.signature(),
+		Intern("given"), Num(n)), Nil).(*ConsCell))
+}
+
+// lookupHead looks up the atom at the head of a form, to see if it names
+// a macro.  A protected atom not bound as such stands for the global it
+// stands for, whatever is in scope.
+func lookupHead(a Atom, e *Env) (Sexpr, bool) {
+	if x, ok := e.lookup(a); ok || a.global() == a {
+		return x, ok
+	}
+	return e.top().getTopLevel(a.global())
+}
+
 func isMacroCall(args Sexpr, e *Env) bool {
 	if args == Nil {
 		return false
@@ -222,7 +127,7 @@ func isMacroCall(args Sexpr, e *Env) bool {
 	if !ok {
 		return false
 	}
-	item, found := e.Lookup(fn.s)
+	item, found := lookupHead(fn, e)
 	if !found {
 		return false
 	}
@@ -237,11 +142,8 @@ func macroexpand1(expr Sexpr, e *Env) (Sexpr, error) {
 	if !isMacroCall(expr, e) {
 		return expr, nil
 	}
-	fn, _ := e.Lookup(expr.(*ConsCell).car.(Atom).s)
-	c, ok := expr.(*ConsCell)
-	if !ok {
-		return nil, baseError("macro call must be a list")
-	}
+	c := expr.(*ConsCell)
+	fn, _ := lookupHead(c.car.(Atom), e)
 	lambda, ok := fn.(*lambdaFn)
 	if !ok {
 		panic("macro call not a lambda function")
@@ -250,26 +152,11 @@ func macroexpand1(expr Sexpr, e *Env) (Sexpr, error) {
 	if err != nil {
 		return nil, extendError("converting macro call to list", err)
 	}
-	eNew := mkEnv(e)
-	if err := setLambdaArgsInEnv(&eNew, lambda, asCons); err != nil {
-		return nil, extendError("setting macro call arguments", err)
-	}
-	ast := lambda.body
-	var ret Sexpr = Nil
-	for {
-		if ast == Nil {
-			return ret, nil
-		}
-		toEval := ast.car
-		ret, err = eval(toEval, &eNew)
-		if err != nil {
-			return nil, extendError("evaluating macro expansion", err)
-		}
-		ast, ok = ast.cdr.(*ConsCell)
-		if !ok {
-			return nil, baseError("macro body must be a list")
-		}
+	ret, err := callFn(lambda, asCons, e)
+	if err != nil {
+		return nil, extendError("evaluating macro expansion", err)
 	}
+	return ret, nil
 }
 
 func macroexpand(expr Sexpr, e *Env) (Sexpr, error) {
@@ -286,7 +173,7 @@ func macroexpand(expr Sexpr, e *Env) (Sexpr, error) {
 	}
 }
 
-func listStartsWith(expr *ConsCell, s string) bool {
+func listStartsWith(expr *ConsCell, a Atom) bool {
 	if expr == Nil {
 		return false
 	}
@@ -294,441 +181,186 @@ func listStartsWith(expr *ConsCell, s string) bool {
 	if !ok {
 		return false
 	}
-	return car.s == s
+	return car.global() == a
 }
 
-// Adapted from
-// https://github.com/kanaka/mal/blob/master/impls/go/src/step7_quote/step7_quote.go#L36,
-// but done recursively:
-func splicingUnquote(l *ConsCell) (*ConsCell, error) {
-	if l == Nil {
-		return Nil, nil
-	}
-	cdr, ok := l.cdr.(*ConsCell)
-	if !ok {
-		return l, nil
-	}
-	nxt, err := splicingUnquote(cdr)
+// syntaxQuote rewrites a syntax-quoted form as code which builds it.
+// Within it, atoms ending in # (e.g. x#) stand for gensyms, the same one
+// for each occurrence, made afresh each time the code runs; atoms naming
+// global functions (in e) are protected (see protected()).  Syntax-quotes
+// nest: an unquote belongs to the innermost syntax-quote around it, and
+// is kept as it is until the code for that syntax-quote runs.
+func syntaxQuote(arg Sexpr, e *Env) (Sexpr, error) {
+	q := quasiquoter{env: e, autos: map[Atom]Atom{}}
+	ret, err := q.quote(arg, 1)
 	if err != nil {
-		return nil, extendError("splicing unquote", err)
+		return nil, err
 	}
-	elt := l.car
-	switch t := elt.(type) {
-	case *ConsCell:
-		if listStartsWith(t, "splicing-unquote") {
-			return Cons(Atom{"concat2"}, Cons(t.cdr.(*ConsCell).car, Cons(nxt, Nil))), nil
-		}
-	default:
+	if len(q.names) == 0 {
+		return ret, nil
 	}
-	return Cons(Atom{"cons"}, Cons(syntaxQuote(elt), Cons(nxt, Nil))), nil
-}
-
-func syntaxQuote(arg Sexpr) Sexpr {
-	switch t := arg.(type) {
-	case Number, Atom:
-		return Cons(Atom{"quote"}, Cons(arg, Nil))
-	case *ConsCell:
-		if listStartsWith(t, "unquote") {
-			return t.cdr.(*ConsCell).car
-		}
-		ret, err := splicingUnquote(t)
-		if err != nil {
-			return nil
-		}
-		return ret
-	default:
-		return t
+	bindings := []Sexpr{}
+	for _, name := range q.names {
+		prefix := Intern(strings.TrimSuffix(name.s, "#"))
+		bindings = append(bindings,
+			list(q.autos[name], list(protected(Intern("gensym")), list(symQuote, prefix))))
 	}
+	return list(symLet, list(bindings...), ret), nil
 }
 
-func evalTest(body *ConsCell, e *Env) (Sexpr, error) {
-	if body == Nil {
-		return Nil, nil
-	}
-	testDesc := body.car
-	evDesc, err := eval(testDesc, e)
-	if err != nil {
-		return nil, extendError("evaluating test description", err)
-	}
-	fmt.Printf("TEST %s ", evDesc)
-	expr, ok := body.cdr.(*ConsCell)
-	if !ok {
-		return nil, baseError("test body must be a list")
-	}
-	for {
-		if expr == Nil {
-			fmt.Println("✓")
-			return Nil, nil
-		}
-		_, err := eval(expr.car, e)
-		if err != nil {
-			return nil, extendError(fmt.Sprintf("evaluating test %s", expr.car), err)
-		}
-		fmt.Print(".")
-		expr, ok = expr.cdr.(*ConsCell)
-		if !ok {
-			return nil, baseError("test body must be a list")
-		}
-	}
+// quasiquoter holds the state of a single syntax-quote expansion.
+type quasiquoter struct {
+	env *Env
+	// Hidden local names for the auto-gensyms, and the order they were seen:
+	autos map[Atom]Atom
+	names []Atom
 }
 
-func eval(exprArg Sexpr, e *Env) (Sexpr, error) {
-	expr := exprArg
-	var err error
-top:
-	if isMacroCall(expr, e) {
-		expr, err = macroexpand(expr, e)
-		if err != nil {
-			return nil, extendError("eval macroexpansion", err)
-		}
-	}
-	switch t := expr.(type) {
+// quote returns code which builds x, at the given depth of nested
+// syntax-quotes; unquotes at depth 1 are evaluated.
+func (q *quasiquoter) quote(x Sexpr, depth int) (Sexpr, error) {
+	switch t := x.(type) {
 	case Atom:
-		if isCxr(t) {
-			return extractCxrLambda(t, e)
+		if depth > 1 {
+			return list(symQuote, t), nil
 		}
-		return evAtom(t, e)
-	case Number:
-		return expr, nil
-	case *ConsCell:
-		if t == Nil {
-			return Nil, nil
-		}
-		cdrCons, ok := t.cdr.(*ConsCell)
-		if !ok {
-			return nil, baseError("malformed list for eval")
-		}
-		// special forms:
-		if carAtom, ok := t.car.(Atom); ok {
-			switch {
-			case carAtom.s == "quote":
-				if cdrCons == Nil {
-					return nil, baseError("quote needs an argument")
-				}
-				return cdrCons.car, nil
-			case carAtom.s == "syntax-quote":
-				if cdrCons == Nil {
-					return nil, baseError("syntax-quote needs an argument")
-				}
-				expr = syntaxQuote(cdrCons.car)
-				goto top
-			case carAtom.s == "test":
-				_, err := evalTest(cdrCons, e)
-				if err != nil {
-					return nil, extendError("test", err)
-				}
-				return Nil, nil
-			case carAtom.s == "cond":
-				pairList := cdrCons
-				if pairList == Nil {
-					return Nil, nil
-				}
-				for {
-					if pairList == Nil {
-						return Nil, nil
-					}
-					pair, ok := pairList.car.(*ConsCell)
-					if !ok || pair == Nil {
-						return nil, baseError("cond requires a list of pairs")
-					}
-					ev, err := eval(pair.car, e)
-					if err != nil {
-						return nil, extendError("evaluating cond condition", err)
-					}
-					if ev == Nil {
-						pairList = pairList.cdr.(*ConsCell)
-						continue
-					}
-					// TAIL CALL!!!
-					cdrCons, ok := pair.cdr.(*ConsCell)
-					if !ok || cdrCons == Nil {
-						return nil, baseError("cond requires a list of pairs")
-					}
-					expr = cdrCons.car
-					goto top
-				}
-			// FIXME: Do as a macro:
-			case carAtom.s == "and":
-				pairList := cdrCons
-				for {
-					if pairList == Nil {
-						return True, nil
-					}
-					ev, err := eval(pairList.car, e)
-					if err != nil {
-						return nil, extendError("and operator", err)
-					}
-					if ev == Nil {
-						return Nil, nil
-					}
-					pairList, ok = pairList.cdr.(*ConsCell)
-					if !ok {
-						return nil, baseError("and requires a list of expressions")
-					}
-				}
-			// FIXME: Do as a macro:
-			case carAtom.s == "or":
-				pairList := cdrCons
-				for {
-					if pairList == Nil {
-						return Nil, nil
-					}
-					ev, err := eval(pairList.car, e)
-					if err != nil {
-						return nil, extendError("or operator", err)
-					}
-					if ev != Nil {
-						return ev, nil
-					}
-					pairList, ok = pairList.cdr.(*ConsCell)
-					if !ok {
-						return nil, baseError("or requires a list of expressions")
-					}
-				}
-			case carAtom.s == "loop":
-				body := cdrCons
-				for {
-					start := body
-				bodyLoop:
-					for {
-						if start == Nil {
-							break bodyLoop
-						}
-						_, err := eval(start.car, e)
-						if err != nil {
-							return nil, extendError("loop operator", err)
-						}
-						start = start.cdr.(*ConsCell)
-					}
-				}
-			case carAtom.s == "swallow":
-				start := cdrCons
-				for {
-					if start == Nil {
-						return Nil, nil
-					}
-					_, err := eval(start.car, e)
-					if err != nil {
-						return True, nil
-					}
-					start = start.cdr.(*ConsCell)
-				}
-			case carAtom.s == "def":
-				return evDef(cdrCons, e)
-			case carAtom.s == "set!":
-				return evSet(cdrCons, e)
-			case carAtom.s == "defn":
-				return evDefn(cdrCons, false, e)
-			case carAtom.s == "defmacro":
-				return evDefn(cdrCons, true, e)
-			case carAtom.s == "error":
-				if cdrCons == Nil {
-					return nil, baseError("error requires a non-empty argument list")
-				}
-				errorExpr, err := eval(cdrCons.car, e)
-				if err != nil {
-					return nil, extendError("error operator", err)
-				}
-				return nil, Cons(errorExpr, Nil)
-			case carAtom.s == "errors":
-				return evErrors(cdrCons, e)
-			case carAtom.s == "try":
-				var ret Sexpr = Nil
-				var err error = nil
-				var hadError bool = false
-				for {
-					if cdrCons == Nil {
-						return ret, err
-					}
-					car, ok := cdrCons.car.(*ConsCell)
-					if ok && car != Nil {
-						carCarAtom, ok := car.car.(Atom)
-						if ok && carCarAtom.s == "catch" {
-							if !hadError {
-								return ret, err
-							}
-							cdr, ok := car.cdr.(*ConsCell)
-							if !ok {
-								return nil, baseError("catch body must be a list with a binding name")
-							}
-							bindingName := cdr.car
-							symStr, ok := bindingName.(Atom)
-							if !ok {
-								return nil, baseError("catch binding name must be a symbol")
-							}
-							eInner := mkEnv(e)
-							errCons, ok := err.(*ConsCell)
-							if !ok {
-								return nil, baseError("catch body must be a list with a binding name")
-							}
-							eInner.Set(symStr.s, errCons)
-
-							cdr, ok = cdr.cdr.(*ConsCell)
-							if !ok {
-								return nil, baseError("catch body must be a list with a binding name")
-							}
-							err = nil
-							for {
-								if cdr == Nil {
-									return ret, err
-								}
-								ret, err = eval(cdr.car, &eInner)
-								if err != nil {
-									return nil, extendError("catch body", err)
-								}
-								cdr, ok = cdr.cdr.(*ConsCell)
-								if !ok {
-									return nil, baseError("catch body must be a list with a binding name")
-								}
-							}
-						}
-					}
-					var ev Sexpr
-					if !hadError {
-						ev, err = eval(cdrCons.car, e)
-						if err != nil {
-							hadError = true
-						} else {
-							ret = ev
-						}
-					}
-					cdrCons, ok = cdrCons.cdr.(*ConsCell)
-					if !ok {
-						return nil, baseError("try requires a list of expressions")
-					}
-				}
-			case carAtom.s == "let":
-				args := cdrCons
-				if args == Nil {
-					return nil, baseError("let requires a binding list")
-				}
-				bindings, ok := args.car.(*ConsCell)
-				if !ok {
-					return nil, baseError("let bindings must be a list")
-				}
-				body, ok := args.cdr.(*ConsCell)
-				if !ok {
-					return nil, baseError("let requires a body")
-				}
-				newEnv := mkEnv(e)
-				for ; bindings != Nil; bindings = bindings.cdr.(*ConsCell) {
-					binding, ok := bindings.car.(*ConsCell)
-					if !ok || binding == Nil {
-						return nil, baseError("a let binding must be a list of binding pairs")
-					}
-					carAtom, ok := binding.car.(Atom)
-					if !ok {
-						return nil, baseError("a let binding must be a list of binding pairs")
-					}
-					asCons, ok := binding.cdr.(*ConsCell)
-					if !ok {
-						return nil, baseError("a let binding must be a list of binding pairs")
-					}
-					if asCons == Nil {
-						return Nil, nil
-					}
-					val, err := eval(asCons.car, e)
-					if err != nil {
-						return nil, extendError("evaluating let bindings", err)
-					}
-					err = newEnv.Set(carAtom.s, val)
-					if err != nil {
-						return nil, extendError("setting let bindings", err)
-					}
-				}
-
-				var ret Sexpr = Nil
-				for {
-					var err error
-					if body == Nil {
-						return ret, nil
-					}
-					// Implement TCO for `let`:
-					if body.cdr == Nil {
-						expr = body.car
-						e = &newEnv
-						goto top
-					}
-					ret, err = eval(body.car, &newEnv)
-					if err != nil {
-						return nil, extendError("evaluating let body", err)
-					}
-					body = body.cdr.(*ConsCell)
-				}
-			case carAtom.s == "lambda":
-				return mkLambda(cdrCons, false, e)
+		if isAutoGensym(t) {
+			hidden, ok := q.autos[t]
+			if !ok {
+				hidden = gensym("-" + t.s)
+				q.autos[t] = hidden
+				q.names = append(q.names, t)
 			}
+			return hidden, nil
 		}
-		// Functions / normal order of evaluation.  Get function to use first:
-		evalCar, err := eval(t.car, e)
-		if err != nil {
-			return nil, extendError("evaluating function object", err)
+		if isGlobalOperator(t, q.env) {
+			t = protected(t)
 		}
-		// In normal function application, evaluate the arguments executing the
-		// function:
-		evaledList := []Sexpr{}
-		start := cdrCons
-		for {
-			if start == Nil {
-				break
-			}
-			ee, err := eval(start.car, e)
-			if err != nil {
-				return nil, extendError("evaluating function arguments", err)
+		return list(symQuote, t), nil
+	case Number:
+		return list(symQuote, t), nil
+	case *ConsCell:
+		for _, level := range []struct {
+			sym   Atom
+			delta int
+		}{{symUnquote, -1}, {symSplicing, -1}, {symSyntaxQuote, 1}} {
+			if !listStartsWith(t, level.sym) {
+				continue
 			}
-			evaledList = append(evaledList, ee)
-			start = start.cdr.(*ConsCell)
-		}
-		// User-defined functions:
-		lambda, ok := evalCar.(*lambdaFn)
-		if ok {
-			var err error
-			newEnv := mkEnv(lambda.env)
-			err = setLambdaArgsInEnv(&newEnv, lambda, evaledList)
+			arg, err := quoteArg(t)
 			if err != nil {
-				return nil, extendError("lambda env setup", err)
+				return nil, err
 			}
-			var ret Sexpr = Nil
-			body := lambda.body
-			for {
-				if body == Nil {
-					return ret, nil
+			if depth+level.delta == 0 {
+				if level.sym == symSplicing {
+					return nil, baseError("splicing-unquote must be used within a list")
 				}
-				// TCO:
-				if body.cdr == Nil {
-					expr = body.car
-					e = &newEnv
-					goto top
-				}
-				ret, err = eval(body.car, &newEnv)
-				if err != nil {
-					return nil, extendWithList(
-						Cons(Atom{"lambda"}, Cons(body.car, Nil)),
-						err)
-				}
-				body = body.cdr.(*ConsCell)
+				return arg, nil
+			}
+			inner, err := q.quote(arg, depth+level.delta)
+			if err != nil {
+				return nil, err
 			}
+			return list(protected(Intern("list")), list(symQuote, level.sym), inner), nil
 		}
-		// Built-in functions:
-		builtin, ok := evalCar.(*Builtin)
-		if !ok {
-			return nil, baseErrorf("%s is not a function", evalCar)
+		return q.quoteList(t, depth)
+	default:
+		return t, nil
+	}
+}
+
+// Adapted from
+// https://github.com/kanaka/mal/blob/master/impls/go/src/step7_quote/step7_quote.go#L36,
+// but done recursively:
+func (q *quasiquoter) quoteList(l *ConsCell, depth int) (Sexpr, error) {
+	if l == Nil {
+		return Nil, nil
+	}
+	var nxt Sexpr
+	var err error
+	switch cdr := l.cdr.(type) {
+	case *ConsCell:
+		switch {
+		case depth == 1 && listStartsWith(cdr, symSplicing):
+			// A spliced dotted tail, (a . ~@b), is the same as (a . ~b):
+			nxt, err = quoteArg(cdr)
+		case listStartsWith(cdr, symUnquote) || listStartsWith(cdr, symSplicing) ||
+			listStartsWith(cdr, symSyntaxQuote):
+			// A dotted tail, e.g. (a . ~b), which reads as (a unquote b):
+			nxt, err = q.quote(cdr, depth)
+		default:
+			nxt, err = q.quoteList(cdr, depth)
 		}
-		biResult, err := builtin.Fn(evaledList, e)
+	default:
+		nxt, err = q.quote(cdr, depth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := l.car.(*ConsCell); ok && depth == 1 && listStartsWith(t, symSplicing) {
+		arg, err := quoteArg(t)
 		if err != nil {
-			return nil, extendError(fmt.Sprintf("builtin function %s",
-				builtin.Name), err)
+			return nil, err
 		}
-		return biResult, nil
-	default:
-		return nil, baseErrorf("unknown expression type: %q", t)
+		return list(protected(Intern("concat2")), arg, nxt), nil
+	}
+	elt, err := q.quote(l.car, depth)
+	if err != nil {
+		return nil, err
+	}
+	return list(protected(Intern("cons")), elt, nxt), nil
+}
+
+// quoteArg returns the argument of an unquote, splicing-unquote or
+// syntax-quote form, which must have exactly one.
+func quoteArg(x *ConsCell) (Sexpr, error) {
+	args, ok := x.cdr.(*ConsCell)
+	if !ok || args == Nil || args.cdr != Nil {
+		return nil, baseErrorf("%s requires exactly one argument", x.car)
+	}
+	return args.car, nil
+}
+
+// isAutoGensym reports whether an atom, such as x#, stands for a gensym in
+// a syntax-quoted form.
+func isAutoGensym(a Atom) bool {
+	return len(a.s) > 1 && strings.HasSuffix(a.s, "#")
+}
+
+// isGlobalOperator reports whether an atom names a special form, or a
+// function or macro at the top level.
+func isGlobalOperator(a Atom, e *Env) bool {
+	if specialFormNames[a.global()] {
+		return true
+	}
+	x, err := lookupGlobal(a.global(), e)
+	if err != nil {
+		return false
 	}
+	switch x.(type) {
+	case *Builtin, *multiFn, *lambdaFn:
+		return true
+	}
+	return false
+}
+
+// eval compiles an expression and runs it on a fresh VM.
+func eval(x Sexpr, e *Env) (Sexpr, error) {
+	return execute(compile(x, e), e)
 }
 
 // Evaluate a list of expressions.  Return any errors.
 func EvalExprs(exprs []Sexpr, e *Env, doPrint bool) error {
+	return evalExprs(threadOf(e), exprs, e, doPrint)
+}
+
+// evalExprs evaluates a list of expressions on the given thread.
+func evalExprs(th *thread, exprs []Sexpr, e *Env, doPrint bool) error {
 	for _, g := range exprs {
-		res, err := eval(g, e)
+		res, err := th.execute(compile(g, e), e)
+		if err == nil && doPrint {
+			err = forcePrinted(res, th.wrap(e))
+		}
 		if err != nil {
 			if doPrint {
 				fmt.Printf("ERROR:\n%v\n", err)
@@ -742,11 +374,28 @@ func EvalExprs(exprs []Sexpr, e *Env, doPrint bool) error {
 	return nil
 }
 
+// EvalExprsContext is like EvalExprs, but stops evaluation with the error
+// (evaluation cancelled) once ctx is done, or with (step limit exceeded)
+// after maxSteps evaluation steps, if maxSteps is positive.
+func EvalExprsContext(ctx context.Context, exprs []Sexpr, e *Env, doPrint bool, maxSteps int) error {
+	return evalExprs(limitedThread(ctx, maxSteps), exprs, e, doPrint)
+}
+
 // LexParseEval lexes, parses, and evaluates the given string.
 func LexParseEval(s string, e *Env) error {
+	return lexParseEval(threadOf(e), s, e)
+}
+
+func lexParseEval(th *thread, s string, e *Env) error {
 	got, err := lexAndParse(strings.Split(s, "\n"))
 	if err != nil {
 		return err
 	}
-	return EvalExprs(got, e, false)
+	return evalExprs(th, got, e, false)
+}
+
+// LexParseEvalContext is like LexParseEval, with limits as for
+// EvalExprsContext.
+func LexParseEvalContext(ctx context.Context, s string, e *Env, maxSteps int) error {
+	return lexParseEval(limitedThread(ctx, maxSteps), s, e)
 }
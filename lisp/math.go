@@ -2,106 +2,181 @@ package lisp
 
 import (
 	"fmt"
+	"math"
 	"math/big"
+	"strconv"
 )
 
-// Number wraps a big.Int (for now)
+// Number is an arbitrary-precision integer.  Numbers which fit in an int64
+// (the vast majority) are held directly in small; others are held in big.
+// Results are always normalized, so a Number has only one representation.
 type Number struct {
-	bi big.Int
+	small int64
+	big   *big.Int // nil unless the number doesn't fit in small
+}
+
+// bigNum returns the Number for b, which is not modified afterwards.
+func bigNum(b *big.Int) Number {
+	if b.IsInt64() {
+		return Number{small: b.Int64()}
+	}
+	return Number{big: b}
+}
+
+// toBig returns the number as a new big.Int.
+func (n Number) toBig() *big.Int {
+	if n.big != nil {
+		return new(big.Int).Set(n.big)
+	}
+	return big.NewInt(n.small)
+}
+
+// int returns the number as an int, for use as a count, coordinate, etc.
+func (n Number) int() int {
+	if n.big != nil {
+		return int(n.big.Int64())
+	}
+	return int(n.small)
 }
 
 // String returns the string representation of the number.
 func (n Number) String() string {
-	return n.bi.Text(10)
+	if n.big != nil {
+		return n.big.Text(10)
+	}
+	return strconv.FormatInt(n.small, 10)
 }
 
 // Add returns the sum of the two numbers.
 func (n Number) Add(o Number) Number {
-	var ni big.Int = n.bi
-	result := big.NewInt(0)
-	result.Add(&ni, &o.bi)
-	return Number{*result}
+	if n.big == nil && o.big == nil {
+		sum := n.small + o.small
+		// Overflow iff both operands have the opposite sign to the sum:
+		if (n.small^sum)&(o.small^sum) >= 0 {
+			return Number{small: sum}
+		}
+	}
+	return bigNum(new(big.Int).Add(n.toBig(), o.toBig()))
 }
 
 // Sub returns the difference of the two numbers.
 func (n Number) Sub(o Number) Number {
-	var ni big.Int = n.bi
-	result := big.NewInt(0)
-	result.Sub(&ni, &o.bi)
-	return Number{*result}
+	if n.big == nil && o.big == nil {
+		diff := n.small - o.small
+		if (n.small^o.small)&(n.small^diff) >= 0 {
+			return Number{small: diff}
+		}
+	}
+	return bigNum(new(big.Int).Sub(n.toBig(), o.toBig()))
 }
 
 // Mul returns the product of the two numbers.
 func (n Number) Mul(o Number) Number {
-	var ni big.Int = n.bi
-	result := big.NewInt(0)
-	result.Mul(&ni, &o.bi)
-	return Number{*result}
+	if n.big == nil && o.big == nil {
+		a, b := n.small, o.small
+		if a == 0 || b == 0 {
+			return Number{}
+		}
+		prod := a * b
+		if prod/b == a && !(a == -1 && b == math.MinInt64) &&
+			!(b == -1 && a == math.MinInt64) {
+			return Number{small: prod}
+		}
+	}
+	return bigNum(new(big.Int).Mul(n.toBig(), o.toBig()))
 }
 
-// Div returns the (integer) quotient of the two numbers.
+// Div returns the (integer) quotient of the two numbers, using Euclidean
+// division, as for big.Int.
 func (n Number) Div(o Number) Number {
-	var ni big.Int = n.bi
-	result := big.NewInt(0)
-	result.Div(&ni, &o.bi)
-	return Number{*result}
+	if n.big == nil && o.big == nil && !(n.small == math.MinInt64 && o.small == -1) {
+		q, r := n.small/o.small, n.small%o.small
+		if r < 0 {
+			if o.small > 0 {
+				q--
+			} else {
+				q++
+			}
+		}
+		return Number{small: q}
+	}
+	return bigNum(new(big.Int).Div(n.toBig(), o.toBig()))
 }
 
 // Rem returns the remainder of the division of two numbers.
 func (n Number) Rem(o Number) Number {
-	var ni big.Int = n.bi
-	result := big.NewInt(0)
-	result.Rem(&ni, &o.bi)
-	return Number{*result}
+	if n.big == nil && o.big == nil {
+		return Number{small: n.small % o.small}
+	}
+	return bigNum(new(big.Int).Rem(n.toBig(), o.toBig()))
+}
+
+// cmp returns -1, 0 or 1 as n is less than, equal to, or greater than o.
+func (n Number) cmp(o Number) int {
+	if n.big == nil && o.big == nil {
+		switch {
+		case n.small < o.small:
+			return -1
+		case n.small > o.small:
+			return 1
+		}
+		return 0
+	}
+	return n.toBig().Cmp(o.toBig())
 }
 
 // Equal returns true if the two numbers are equal.
 func (n Number) Equal(o Sexpr) bool {
 	if o, ok := o.(Number); ok {
-		return n.bi.Cmp(&o.bi) == 0
+		return n.cmp(o) == 0
 	}
 	return false
 }
 
 // Less returns true if the first number is less than the second.
 func (n Number) Less(o Number) bool {
-	return n.bi.Cmp(&o.bi) < 0
+	return n.cmp(o) < 0
 }
 
 // LessEqual returns true if the first number is <= the second.
 func (n Number) LessEqual(o Number) bool {
-	return n.bi.Cmp(&o.bi) <= 0
+	return n.cmp(o) <= 0
 }
 
 // Greater returns true if the first number is greater than the second.
 func (n Number) Greater(o Number) bool {
-	return n.bi.Cmp(&o.bi) > 0
+	return n.cmp(o) > 0
 }
 
 // GreaterEqual returns true if the first number is >= the second.
 func (n Number) GreaterEqual(o Number) bool {
-	return n.bi.Cmp(&o.bi) >= 0
+	return n.cmp(o) >= 0
 }
 
 // Neg returns the negative of the number.
 func (n Number) Neg() Number {
-	var ni big.Int = n.bi
-	result := big.NewInt(0)
-	result.Neg(&ni)
-	return Number{*result}
+	if n.big == nil && n.small != math.MinInt64 {
+		return Number{small: -n.small}
+	}
+	return bigNum(new(big.Int).Neg(n.toBig()))
 }
 
 // Num is a `num` constructor, which can take a string or a
 // ("normal") number.
 func Num(ob interface{}) Number {
-	var n Number
 	switch s := ob.(type) {
 	case string:
-		n.bi.SetString(s, 10)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return Number{small: i}
+		}
+		b, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return Number{}
+		}
+		return bigNum(b)
 	case int:
-		n.bi.SetInt64(int64(s))
+		return Number{small: int64(s)}
 	default:
 		panic(fmt.Sprintf("Num: unknown type %T\n", ob))
 	}
-	return n
 }
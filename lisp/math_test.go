@@ -1,6 +1,9 @@
 package lisp
 
 import (
+	"math"
+	"math/big"
+	"strconv"
 	"testing"
 )
 
@@ -72,3 +75,47 @@ func TestUnaryOps(t *testing.T) {
 		t.Logf("Num(9999999999999).Neg() == Num(-9999999999999)")
 	}
 }
+
+// TestSmallAndBig checks that arithmetic on numbers near the int64 limits
+// agrees with big.Int.
+func TestSmallAndBig(t *testing.T) {
+	vals := []string{"0", "1", "-1", "2", "-2", "7", "-7", "3037000500", "-3037000500",
+		strconv.FormatInt(math.MaxInt64, 10), strconv.FormatInt(math.MaxInt64-1, 10),
+		strconv.FormatInt(math.MinInt64, 10), strconv.FormatInt(math.MinInt64+1, 10),
+		"9223372036854775808", "-9223372036854775809", "123456789012345678901234567890"}
+	bigOf := func(s string) *big.Int {
+		b, _ := new(big.Int).SetString(s, 10)
+		return b
+	}
+	ops := []struct {
+		name string
+		num  func(a, b Number) Number
+		big  func(z, a, b *big.Int) *big.Int
+	}{
+		{"+", Number.Add, (*big.Int).Add},
+		{"-", Number.Sub, (*big.Int).Sub},
+		{"*", Number.Mul, (*big.Int).Mul},
+		{"/", Number.Div, (*big.Int).Div},
+		{"rem", Number.Rem, (*big.Int).Rem},
+	}
+	for _, a := range vals {
+		for _, b := range vals {
+			for _, op := range ops {
+				if b == "0" && (op.name == "/" || op.name == "rem") {
+					continue
+				}
+				got := op.num(Num(a), Num(b))
+				want := op.big(new(big.Int), bigOf(a), bigOf(b))
+				if got.String() != want.String() || !got.Equal(Num(want.String())) {
+					t.Errorf("%s %s %s = %s, want %s", a, op.name, b, got, want)
+				}
+				if got.Less(Num(a)) != (want.Cmp(bigOf(a)) < 0) {
+					t.Errorf("(%s %s %s) < %s wrong", a, op.name, b, a)
+				}
+			}
+		}
+		if got, want := Num(a).Neg(), new(big.Int).Neg(bigOf(a)); got.String() != want.String() {
+			t.Errorf("-(%s) = %s, want %s", a, got, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package lisp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// multiFn is a multimethod: a function which applies a dispatch function
+// to its arguments, then calls the method registered (with defmethod) for
+// the result, or the one registered for :default.
+type multiFn struct {
+	name     Atom
+	doc      *ConsCell
+	dispatch Sexpr
+	// Methods, in the order they were first registered, guarded by mu as
+	// goroutines may add methods while others call the multimethod:
+	mu      sync.RWMutex
+	methods []method
+}
+
+type method struct {
+	value Sexpr
+	fn    Sexpr
+}
+
+var kwDefault = Intern(":default")
+
+func (m *multiFn) String() string {
+	return fmt.Sprintf("<multimethod %s>", m.name)
+}
+
+func (m *multiFn) Equal(o Sexpr) bool {
+	return m == o
+}
+
+// addMethod registers fn as the method for the dispatch value, replacing
+// any method already registered for it.
+func (m *multiFn) addMethod(value, fn Sexpr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := fn.(*lambdaFn); ok && l.defName == noName {
+		l.defName = m.name
+	}
+	for i, meth := range m.methods {
+		if meth.value.Equal(value) {
+			m.methods[i].fn = fn
+			return
+		}
+	}
+	m.methods = append(m.methods, method{value, fn})
+}
+
+// method returns the method to call for the given arguments.
+func (m *multiFn) method(args []Sexpr, e *Env) (Sexpr, error) {
+	value, err := callFn(m.dispatch, args, e)
+	if err != nil {
+		return nil, extendError(fmt.Sprintf("dispatch for multimethod %s", m.name), err)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var dflt Sexpr
+	for _, meth := range m.methods {
+		if meth.value.Equal(value) {
+			return meth.fn, nil
+		}
+		if meth.value == kwDefault {
+			dflt = meth.fn
+		}
+	}
+	if dflt != nil {
+		return dflt, nil
+	}
+	return nil, baseErrorf("no method in multimethod %s for dispatch value %s", m.name, value)
+}
+
+// docList returns the multimethod's documentation, followed by a list of
+// the dispatch values it has methods for.
+func (m *multiFn) docList() *ConsCell {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values := []Sexpr{}
+	for _, meth := range m.methods {
+		values = append(values, meth.value)
+	}
+	doc, _ := consToExprs(m.doc)
+	return list(append(doc, Cons(Intern("methods:"), list(values...)))...)
+}
+
+// Helpers for the defmulti and defmethod forms (see compile.go), which
+// compile to calls of these:
+var (
+	mkMultiFn = &Builtin{
+		Name:       "defmulti",
+		FixedArity: 3,
+		Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			return &multiFn{
+				name:     args[0].(Atom),
+				doc:      args[1].(*ConsCell),
+				dispatch: args[2],
+			}, nil
+		},
+	}
+	addMethodFn = &Builtin{
+		Name:       "defmethod",
+		FixedArity: 3,
+		Fn: func(args []Sexpr, _ *Env) (Sexpr, error) {
+			m, ok := args[0].(*multiFn)
+			if !ok {
+				return nil, baseErrorf("'%s' is not a multimethod", args[0])
+			}
+			m.addMethod(args[1], args[2])
+			return Nil, nil
+		},
+	}
+)
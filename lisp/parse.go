@@ -8,7 +8,7 @@ func handleQuoteItem(tokens []Token, i int, operatorName string) (Sexpr, int, er
 	if err != nil {
 		return nil, 0, extendError("handleQuoteItem parseNext", err)
 	}
-	item := Cons(Atom{operatorName}, Cons(nextParsed, Nil))
+	item := Cons(Intern(operatorName), Cons(nextParsed, Nil))
 	return item, incr, nil
 }
 
@@ -21,7 +21,7 @@ func parseNext(tokens []Token, i int) (Sexpr, int, error) {
 	case itemNumber:
 		return Num(token.lexeme.Val), 1, nil
 	case itemAtom:
-		return Atom{token.lexeme.Val}, 1, nil
+		return Intern(token.lexeme.Val), 1, nil
 	case itemForwardQuote:
 		item, incr, err := handleQuoteItem(tokens, i+1, "quote")
 		if err != nil {
@@ -14,37 +14,37 @@ func TestParse(t *testing.T) {
 		error string
 	}{
 		{"()", Nil, OK},
-		{"a", Atom{"a"}, OK},
+		{"a", Intern("a"), OK},
 		{"(1)", Cons(Num(1), Nil), OK},
-		{"(a b)", Cons(Atom{"a"}, Cons(Atom{"b"}, Nil)), OK},
-		{"(a . b)", Cons(Atom{"a"}, Atom{"b"}), OK},
-		{"((a . b))", Cons(Cons(Atom{"a"}, Atom{"b"}), Nil), OK},
-		{"(quote a)", Cons(Atom{"quote"}, Cons(Atom{"a"}, Nil)), OK},
-		{"'(a b)", Cons(Atom{"quote"}, Cons(Cons(Atom{"a"}, Cons(Atom{"b"}, Nil)), Nil)), OK},
-		{"'(a . b)", Cons(Atom{"quote"}, Cons(Cons(Atom{"a"}, Atom{"b"}), Nil)), OK},
-		{"'((a b) . c)", Cons(Atom{"quote"}, Cons(Cons(Cons(Atom{"a"}, Cons(Atom{"b"}, Nil)), Atom{"c"}), Nil)), OK},
-		{"(a b . c)", Cons(Atom{"a"}, Cons(Atom{"b"}, Atom{"c"})), OK},
+		{"(a b)", Cons(Intern("a"), Cons(Intern("b"), Nil)), OK},
+		{"(a . b)", Cons(Intern("a"), Intern("b")), OK},
+		{"((a . b))", Cons(Cons(Intern("a"), Intern("b")), Nil), OK},
+		{"(quote a)", Cons(Intern("quote"), Cons(Intern("a"), Nil)), OK},
+		{"'(a b)", Cons(Intern("quote"), Cons(Cons(Intern("a"), Cons(Intern("b"), Nil)), Nil)), OK},
+		{"'(a . b)", Cons(Intern("quote"), Cons(Cons(Intern("a"), Intern("b")), Nil)), OK},
+		{"'((a b) . c)", Cons(Intern("quote"), Cons(Cons(Cons(Intern("a"), Cons(Intern("b"), Nil)), Intern("c")), Nil)), OK},
+		{"(a b . c)", Cons(Intern("a"), Cons(Intern("b"), Intern("c"))), OK},
 		{"(1 2 3 . 4)", Cons(Num(1), Cons(Num(2), Cons(Num(3), Num(4)))), OK},
 		{"((1) 2 3 . 4)", Cons(Cons(Num(1), Nil), Cons(Num(2), Cons(Num(3), Num(4)))), OK},
 		{"(1 (2 . 3) 4 . 5)", Cons(Num(1), Cons(Cons(Num(2), Num(3)), Cons(Num(4), Num(5)))), OK},
 		{"(1 2 . (3 4))", Cons(Num(1), Cons(Num(2), Cons(Num(3), Cons(Num(4), Nil)))), OK},
 		{"(1 2 . (3 . 4))", Cons(Num(1), Cons(Num(2), Cons(Num(3), Num(4)))), OK},
-		{"'((a) . b)", Cons(Atom{"quote"}, Cons(Cons(Cons(Atom{"a"}, Nil), Atom{"b"}), Nil)), OK},
-		{"`a", Cons(Atom{"syntax-quote"}, Cons(Atom{"a"}, Nil)), OK},
-		{"`(a b)", Cons(Atom{"syntax-quote"}, Cons(Cons(Atom{"a"}, Cons(Atom{"b"}, Nil)), Nil)), OK},
-		{"`(a . b)", Cons(Atom{"syntax-quote"}, Cons(Cons(Atom{"a"}, Atom{"b"}), Nil)), OK},
-		{"~b", Cons(Atom{"unquote"}, Cons(Atom{"b"}, Nil)), OK},
-		{"`~b", Cons(Atom{"syntax-quote"}, Cons(Cons(Atom{"unquote"}, Cons(Atom{"b"}, Nil)), Nil)), OK},
-		{"`(~b)", Cons(Atom{"syntax-quote"}, Cons(Cons(Cons(Atom{"unquote"}, Cons(Atom{"b"}, Nil)), Nil), Nil)), OK},
-		{"~@c", Cons(Atom{"splicing-unquote"}, Cons(Atom{"c"}, Nil)), OK},
-		{"`(a ~b ~@c)", Cons(Atom{"syntax-quote"},
-			Cons(Cons(Atom{"a"},
-				Cons(Cons(Atom{"unquote"},
-					Cons(Atom{"b"}, Nil)),
-					Cons(Cons(Atom{"splicing-unquote"},
-						Cons(Atom{"c"}, Nil)), Nil))), Nil)), OK},
-		{"#_(a b c)", Cons(Atom{"comment"}, Cons(Cons(Atom{"a"}, Cons(Atom{"b"}, Cons(Atom{"c"}, Nil))), Nil)), OK},
-		{"#_1", Cons(Atom{"comment"}, Cons(Num(1), Nil)), OK},
+		{"'((a) . b)", Cons(Intern("quote"), Cons(Cons(Cons(Intern("a"), Nil), Intern("b")), Nil)), OK},
+		{"`a", Cons(Intern("syntax-quote"), Cons(Intern("a"), Nil)), OK},
+		{"`(a b)", Cons(Intern("syntax-quote"), Cons(Cons(Intern("a"), Cons(Intern("b"), Nil)), Nil)), OK},
+		{"`(a . b)", Cons(Intern("syntax-quote"), Cons(Cons(Intern("a"), Intern("b")), Nil)), OK},
+		{"~b", Cons(Intern("unquote"), Cons(Intern("b"), Nil)), OK},
+		{"`~b", Cons(Intern("syntax-quote"), Cons(Cons(Intern("unquote"), Cons(Intern("b"), Nil)), Nil)), OK},
+		{"`(~b)", Cons(Intern("syntax-quote"), Cons(Cons(Cons(Intern("unquote"), Cons(Intern("b"), Nil)), Nil), Nil)), OK},
+		{"~@c", Cons(Intern("splicing-unquote"), Cons(Intern("c"), Nil)), OK},
+		{"`(a ~b ~@c)", Cons(Intern("syntax-quote"),
+			Cons(Cons(Intern("a"),
+				Cons(Cons(Intern("unquote"),
+					Cons(Intern("b"), Nil)),
+					Cons(Cons(Intern("splicing-unquote"),
+						Cons(Intern("c"), Nil)), Nil))), Nil)), OK},
+		{"#_(a b c)", Cons(Intern("comment"), Cons(Cons(Intern("a"), Cons(Intern("b"), Cons(Intern("c"), Nil))), Nil)), OK},
+		{"#_1", Cons(Intern("comment"), Cons(Num(1), Nil)), OK},
 		{"#!/bin/bash\n(1 2)\n", Cons(Num(1), Cons(Num(2), Nil)), OK},
 		{"\n\n#!/bin/bash\n(1 2)\n", Cons(Num(1), Cons(Num(2), Nil)), OK},
 		// Make sure that shebang must come first...
@@ -63,7 +63,7 @@ func TestStrToSexprs(T *testing.T) {
 		return cons
 	}
 	A := func(s string) Atom {
-		return Atom{s}
+		return Intern(s)
 	}
 	var happyPathTests = []struct {
 		input string
@@ -130,3 +130,70 @@ func TestStrToSexprs(T *testing.T) {
 		}
 	}
 }
+
+func TestIntern(t *testing.T) {
+	if Intern("foo") != Intern("foo") {
+		t.Error("atoms with the same name should be identical")
+	}
+	if Intern("foo").Equal(Intern("bar")) {
+		t.Error("atoms with different names should differ")
+	}
+	g := gensym("")
+	if g.Equal(Intern(g.s)) || g.Equal(gensym("")) {
+		t.Errorf("gensym %s should not equal any other atom", g)
+	}
+	if !g.Equal(g) {
+		t.Errorf("gensym %s should equal itself", g)
+	}
+}
+
+func TestProtected(t *testing.T) {
+	foo := Intern("foo")
+	p := protected(foo)
+	if p == foo || p != protected(foo) || protected(p) != p {
+		t.Error("an atom should have exactly one protected counterpart")
+	}
+	if !p.Equal(foo) || !foo.Equal(p) || p.global() != foo {
+		t.Errorf("protected atom %s should stand for %s", p, foo)
+	}
+	if p.String() != "foo" {
+		t.Errorf("protected atom prints as %q", p.String())
+	}
+}
+
+func TestLazyString(t *testing.T) {
+	e := mkEnv(nil)
+	forced := 0
+	var from func(n int) Sexpr
+	from = func(n int) Sexpr {
+		next := &Builtin{
+			Name: "next",
+			Fn: func([]Sexpr, *Env) (Sexpr, error) {
+				forced++
+				return from(n + 1), nil
+			},
+		}
+		return Cons(Num(n), &delay{fn: next, env: &e})
+	}
+	saved := PrintLength
+	PrintLength = 3
+	defer func() { PrintLength = saved }()
+	s := from(0)
+	// Rendering a list forces nothing:
+	if s.String() != "(0 ...)" || forced != 0 {
+		t.Errorf("unforced lazy sequence printed as %s, forcing %d tails", s, forced)
+	}
+	// ... that is left to printing builtins:
+	if err := forcePrinted(s, &e); err != nil {
+		t.Fatal(err)
+	}
+	if s.String() != "(0 1 2 ...)" {
+		t.Errorf("infinite lazy sequence printed as %s", s)
+	}
+	if forced != 3 {
+		t.Errorf("printing forced %d tails, want 3", forced)
+	}
+	if err := forcePrinted(s, &e); err != nil || forced != 3 {
+		t.Error("tails of a lazy sequence should be forced only once")
+	}
+}
@@ -31,7 +31,7 @@ func doShell(arg Sexpr) (Sexpr, error) {
 		case Atom:
 			cmdStrings = append(cmdStrings, t.s)
 		case Number:
-			cmdStrings = append(cmdStrings, t.bi.String())
+			cmdStrings = append(cmdStrings, t.String())
 		default:
 			return nil, baseErrorf("shell argument must be a nonempty list of strings")
 		}
@@ -1,12 +1,16 @@
 package lisp
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+)
 
-var gensymCounter = 0
+var gensymCounter int64
 
-// Currently we only have one thread.  If we ever have concurrency, ensure
-// thread safety.
-func gensym(prefix string) string {
-	gensymCounter++
-	return fmt.Sprintf("<gensym%s-%d>", prefix, gensymCounter)
+// gensym returns a new, uninterned atom, which can't clash with any other,
+// even one which prints the same way.  The counter is shared by all
+// goroutines, so it is incremented atomically.
+func gensym(prefix string) Atom {
+	n := atomic.AddInt64(&gensymCounter, 1)
+	return uninterned(fmt.Sprintf("<gensym%s-%d>", prefix, n))
 }
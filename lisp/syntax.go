@@ -0,0 +1,559 @@
+package lisp
+
+import "fmt"
+
+// Pattern-based macros: defsyntax defines a macro by a list of rules, each
+// a pattern and a template, e.g.
+//
+//	(defsyntax swap! ()
+//	  ((_ a b) (let ((tmp a))
+//	             (set! a b)
+//	             (set! b tmp))))
+//
+// A call of the macro is matched against each pattern in turn, and is
+// replaced by the template of the first which matches, with the pattern's
+// variables filled in.  A pattern element followed by ... matches any
+// number of forms; the variables in it must be followed by ... in the
+// template, too.  Names bound by the template (like tmp above) are renamed
+// afresh for every expansion, and its other names refer to their global
+// definitions, so expansions neither capture nor are captured by names at
+// the call site.  Names listed as literals (the list following the macro's
+// name) match only themselves in patterns, and are left as they are in
+// templates.
+
+var (
+	symDefsyntax = Intern("defsyntax")
+	symEllipsis  = Intern("...")
+	symWildcard  = Intern("_")
+)
+
+type syntaxRules struct {
+	name     Atom
+	literals map[Atom]bool
+	rules    []syntaxRule
+}
+
+type syntaxRule struct {
+	pattern  *ConsCell
+	template Sexpr
+	// The depth of ... nesting of each pattern variable:
+	vars map[Atom]int
+	// The names the template binds, to be renamed for each expansion:
+	bound map[Atom]bool
+}
+
+// syntaxBinding is what a pattern variable matched: a form, or, for
+// variables under ..., a list of bindings, one per repetition.
+type syntaxBinding struct {
+	form Sexpr
+	reps []*syntaxBinding
+}
+
+// mkSyntaxRules parses the literals and rules of a defsyntax form.
+func mkSyntaxRules(name Atom, literals Sexpr, rules []Sexpr) (*syntaxRules, error) {
+	lits, err := consToExprs(literals)
+	if err != nil {
+		return nil, baseError("defsyntax requires a list of literals")
+	}
+	ret := &syntaxRules{name: name, literals: map[Atom]bool{}}
+	for _, l := range lits {
+		a, ok := l.(Atom)
+		if !ok {
+			return nil, baseErrorf("defsyntax literal '%s' is not an atom", l)
+		}
+		ret.literals[a] = true
+	}
+	for _, r := range rules {
+		rule, err := ret.mkRule(r)
+		if err != nil {
+			return nil, extendError(fmt.Sprintf("syntax rule %s", r), err)
+		}
+		ret.rules = append(ret.rules, rule)
+	}
+	return ret, nil
+}
+
+func (s *syntaxRules) mkRule(r Sexpr) (syntaxRule, error) {
+	parts, err := consToExprs(r)
+	if err != nil || len(parts) != 2 {
+		return syntaxRule{}, baseError("a syntax rule must be a (pattern template) pair")
+	}
+	pattern, ok := parts[0].(*ConsCell)
+	if !ok || pattern == Nil {
+		return syntaxRule{}, baseError("a syntax rule pattern must be a list")
+	}
+	if _, ok := pattern.car.(Atom); !ok {
+		return syntaxRule{}, baseError("a syntax rule pattern must start with an atom")
+	}
+	rule := syntaxRule{
+		pattern:  pattern,
+		template: parts[1],
+		vars:     map[Atom]int{},
+		bound:    map[Atom]bool{},
+	}
+	if err := s.patternVars(pattern.cdr, 0, rule.vars); err != nil {
+		return syntaxRule{}, err
+	}
+	if err := checkTemplate(rule.template, 0, rule.vars); err != nil {
+		return syntaxRule{}, err
+	}
+	templateBinds(rule.template, rule.bound)
+	for v := range rule.vars {
+		delete(rule.bound, v)
+	}
+	for l := range s.literals {
+		delete(rule.bound, l)
+	}
+	return rule, nil
+}
+
+// patternVars records the variables in a pattern, with their depths.
+func (s *syntaxRules) patternVars(p Sexpr, depth int, vars map[Atom]int) error {
+	switch t := p.(type) {
+	case Atom:
+		if t == symEllipsis {
+			return baseError("misplaced ... in pattern")
+		}
+		if t == symWildcard || t == True || isKeyword(t) || s.literals[t] {
+			return nil
+		}
+		if _, ok := vars[t]; ok {
+			return baseErrorf("pattern variable %s appears more than once", t)
+		}
+		vars[t] = depth
+	case *ConsCell:
+		elems, tail := splitList(t)
+		seen := false
+		for i, x := range elems {
+			if x == symEllipsis {
+				if i == 0 || seen {
+					return baseError("misplaced ... in pattern")
+				}
+				seen = true
+				continue
+			}
+			d := depth
+			if i+1 < len(elems) && elems[i+1] == symEllipsis {
+				d++
+			}
+			if err := s.patternVars(x, d, vars); err != nil {
+				return err
+			}
+		}
+		if tail != Nil {
+			return s.patternVars(tail, depth, vars)
+		}
+	}
+	return nil
+}
+
+// checkTemplate checks that pattern variables appear in a template under
+// as many ... as in their patterns, and that each ... follows a form
+// which has a variable to repeat.
+func checkTemplate(t Sexpr, depth int, vars map[Atom]int) error {
+	switch x := t.(type) {
+	case Atom:
+		if d, ok := vars[x]; ok && d > depth {
+			return baseErrorf("pattern variable %s must be followed by ... in template", x)
+		}
+	case *ConsCell:
+		if x == Nil || isEllipsisEscape(x) {
+			return nil
+		}
+		elems, tail := splitList(x)
+		for i, elem := range elems {
+			if elem == symEllipsis {
+				if i == 0 {
+					return baseError("misplaced ... in template")
+				}
+				continue
+			}
+			d := depth
+			if i+1 < len(elems) && elems[i+1] == symEllipsis {
+				d++
+				if !hasVarDeeperThan(elem, depth, vars) {
+					return baseErrorf("no pattern variable to repeat before ... in %s", x)
+				}
+			}
+			if err := checkTemplate(elem, d, vars); err != nil {
+				return err
+			}
+		}
+		return checkTemplate(tail, depth, vars)
+	}
+	return nil
+}
+
+func hasVarDeeperThan(t Sexpr, depth int, vars map[Atom]int) bool {
+	switch x := t.(type) {
+	case Atom:
+		d, ok := vars[x]
+		return ok && d > depth
+	case *ConsCell:
+		for x != Nil {
+			if hasVarDeeperThan(x.car, depth, vars) {
+				return true
+			}
+			next, ok := x.cdr.(*ConsCell)
+			if !ok {
+				return hasVarDeeperThan(x.cdr, depth, vars)
+			}
+			x = next
+		}
+	}
+	return false
+}
+
+func occursIn(a Atom, t Sexpr) bool {
+	switch x := t.(type) {
+	case Atom:
+		return x == a
+	case *ConsCell:
+		return x != Nil && (occursIn(a, x.car) || occursIn(a, x.cdr))
+	}
+	return false
+}
+
+// isEllipsisEscape reports whether x is (... ...), which stands for ...
+// itself in a template.
+func isEllipsisEscape(x *ConsCell) bool {
+	elems, tail := splitList(x)
+	return tail == Nil && len(elems) == 2 && elems[0] == symEllipsis && elems[1] == symEllipsis
+}
+
+// templateBinds records the names a template binds with let, let*, letfn
+// or lambda.
+func templateBinds(t Sexpr, bound map[Atom]bool) {
+	x, ok := t.(*ConsCell)
+	if !ok || x == Nil {
+		return
+	}
+	elems, _ := splitList(x)
+	addNames := func(p Sexpr) {
+		if names, err := patternNames(p); err == nil {
+			for _, n := range names {
+				bound[n] = true
+			}
+		}
+	}
+	addArgs := func(args Sexpr) {
+		as, _ := splitList(args)
+		defaults := false
+		for _, a := range as {
+			switch c, ok := a.(*ConsCell); {
+			case a == symOptional || a == symKey:
+				defaults = true
+			case defaults && ok && c != Nil:
+				// A (name default) pair:
+				addNames(c.car)
+			default:
+				addNames(a)
+			}
+		}
+		if _, tail := splitList(args); tail != Nil {
+			addNames(tail)
+		}
+	}
+	lambdaArgs := func(rest []Sexpr) {
+		if len(rest) > 0 {
+			if name, ok := rest[0].(Atom); ok && name != symArities {
+				bound[name] = true
+				rest = rest[1:]
+			}
+		}
+		if len(rest) > 0 && rest[0] == symArities {
+			for _, clause := range rest[1:] {
+				if c, ok := clause.(*ConsCell); ok && c != Nil && !listStartsWith(c, symDoc) {
+					addArgs(c.car)
+				}
+			}
+			return
+		}
+		if len(rest) > 0 {
+			addArgs(rest[0])
+		}
+	}
+	switch {
+	case len(elems) > 1 && (x.car == symLet || x.car == Intern("let*")):
+		bindings, _ := splitList(elems[1])
+		for _, b := range bindings {
+			if c, ok := b.(*ConsCell); ok && c != Nil {
+				addNames(c.car)
+			}
+		}
+	case len(elems) > 1 && x.car == symLetfn:
+		defs, _ := splitList(elems[1])
+		for _, d := range defs {
+			if c, ok := d.(*ConsCell); ok && c != Nil {
+				parts, _ := splitList(c)
+				lambdaArgs(parts)
+			}
+		}
+	case x.car == symLambda:
+		lambdaArgs(elems[1:])
+	case x.car == symQuote:
+		return
+	}
+	for _, elem := range elems {
+		templateBinds(elem, bound)
+	}
+}
+
+// splitList returns the elements of a list, and its tail: Nil for a
+// proper list, or whatever follows the dot.
+func splitList(x Sexpr) ([]Sexpr, Sexpr) {
+	elems := []Sexpr{}
+	for {
+		c, ok := x.(*ConsCell)
+		if !ok || c == Nil {
+			return elems, x
+		}
+		elems = append(elems, c.car)
+		x = c.cdr
+	}
+}
+
+// expand expands a call of the macro, given the list of the call's
+// arguments.
+func (s *syntaxRules) expand(args []Sexpr, e *Env) (Sexpr, error) {
+	form := args[0]
+	for _, rule := range s.rules {
+		b := map[Atom]*syntaxBinding{}
+		if !s.match(rule.pattern.cdr, form, b) {
+			continue
+		}
+		x := expansion{rules: s, rule: rule, env: e, renames: map[Atom]Atom{}}
+		return x.fill(rule.template, b)
+	}
+	patterns := []Sexpr{}
+	for _, rule := range s.rules {
+		patterns = append(patterns, rule.pattern)
+	}
+	return nil, startStacktrace(list(
+		Intern("no"), Intern("syntax"), Intern("rule"), Intern("matches"),
+		Cons(s.name, form), Intern("tried"), list(patterns...)))
+}
+
+// match matches a form against a pattern, recording what the pattern's
+// variables matched in b.
+func (s *syntaxRules) match(p, x Sexpr, b map[Atom]*syntaxBinding) bool {
+	switch t := p.(type) {
+	case Atom:
+		switch {
+		case t == symWildcard:
+			return true
+		case t == True || isKeyword(t) || s.literals[t]:
+			return t.Equal(x)
+		}
+		b[t] = &syntaxBinding{form: x}
+		return true
+	case *ConsCell:
+		if t == Nil {
+			return x == Nil
+		}
+		if _, ok := x.(*ConsCell); !ok {
+			return false
+		}
+		return s.matchList(t, x, b)
+	}
+	return p.Equal(x)
+}
+
+func (s *syntaxRules) matchList(p *ConsCell, x Sexpr, b map[Atom]*syntaxBinding) bool {
+	pats, ptail := splitList(p)
+	xs, xtail := splitList(x)
+	ell := -1
+	for i, pat := range pats {
+		if pat == symEllipsis {
+			ell = i
+		}
+	}
+	if ell < 0 {
+		if len(xs) < len(pats) || (ptail == Nil && len(xs) > len(pats)) {
+			return false
+		}
+		for i, pat := range pats {
+			if !s.match(pat, xs[i], b) {
+				return false
+			}
+		}
+		if ptail == Nil {
+			return xtail == Nil
+		}
+		return s.match(ptail, mkListAsConsWithCdr(xs[len(pats):], xtail), b)
+	}
+	before, rep, after := pats[:ell-1], pats[ell-1], pats[ell+1:]
+	if len(xs) < len(before)+len(after) || (ptail == Nil && xtail != Nil) {
+		return false
+	}
+	for i, pat := range before {
+		if !s.match(pat, xs[i], b) {
+			return false
+		}
+	}
+	n := len(xs) - len(after)
+	for i, pat := range after {
+		if !s.match(pat, xs[n+i], b) {
+			return false
+		}
+	}
+	vars := map[Atom]int{}
+	_ = s.patternVars(rep, 0, vars)
+	reps := map[Atom]*syntaxBinding{}
+	for v := range vars {
+		reps[v] = &syntaxBinding{reps: []*syntaxBinding{}}
+	}
+	for _, item := range xs[len(before):n] {
+		bi := map[Atom]*syntaxBinding{}
+		if !s.match(rep, item, bi) {
+			return false
+		}
+		for v := range vars {
+			reps[v].reps = append(reps[v].reps, bi[v])
+		}
+	}
+	for v, r := range reps {
+		b[v] = r
+	}
+	if ptail != Nil {
+		return s.match(ptail, xtail, b)
+	}
+	return true
+}
+
+// expansion holds the state of a single expansion of a rule.
+type expansion struct {
+	rules *syntaxRules
+	rule  syntaxRule
+	env   *Env
+	// The fresh names for the names the template binds:
+	renames map[Atom]Atom
+	// Whether the template being filled in is quoted data, whose names
+	// are left as they are:
+	quoted bool
+}
+
+// fill fills in a template with the pattern variables' bindings.
+func (x *expansion) fill(t Sexpr, b map[Atom]*syntaxBinding) (Sexpr, error) {
+	switch tt := t.(type) {
+	case Atom:
+		if v, ok := b[tt]; ok {
+			return v.form, nil
+		}
+		if x.quoted {
+			return tt, nil
+		}
+		return x.rename(tt), nil
+	case *ConsCell:
+		if tt == Nil {
+			return Nil, nil
+		}
+		if isEllipsisEscape(tt) {
+			return symEllipsis, nil
+		}
+		if tt.car == symQuote && !x.quoted {
+			x.quoted = true
+			defer func() { x.quoted = false }()
+		}
+		elems, tail := splitList(tt)
+		ret := []Sexpr{}
+		for i := 0; i < len(elems); i++ {
+			if i+1 < len(elems) && elems[i+1] == symEllipsis {
+				items, err := x.fillRepeated(elems[i], b)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, items...)
+				i++
+				continue
+			}
+			item, err := x.fill(elems[i], b)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, item)
+		}
+		filledTail, err := x.fill(tail, b)
+		if err != nil {
+			return nil, err
+		}
+		return mkListAsConsWithCdr(ret, filledTail), nil
+	}
+	return t, nil
+}
+
+// fillRepeated fills in a template element followed by ..., once for each
+// repetition of the pattern variables in it.
+func (x *expansion) fillRepeated(t Sexpr, b map[Atom]*syntaxBinding) ([]Sexpr, error) {
+	n := -1
+	repeated := []Atom{}
+	for v, binding := range b {
+		if binding.reps == nil || !occursIn(v, t) {
+			continue
+		}
+		if n >= 0 && len(binding.reps) != n {
+			return nil, baseErrorf("pattern variables repeated together matched different numbers of forms in %s", t)
+		}
+		n = len(binding.reps)
+		repeated = append(repeated, v)
+	}
+	ret := []Sexpr{}
+	for i := 0; i < n; i++ {
+		bi := map[Atom]*syntaxBinding{}
+		for v, binding := range b {
+			bi[v] = binding
+		}
+		for _, v := range repeated {
+			bi[v] = b[v].reps[i]
+		}
+		item, err := x.fill(t, bi)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+// rename returns the atom to use in an expansion for a name in a template
+// which isn't a pattern variable.  Names the template binds are renamed
+// afresh; other names, including those of macros and special forms, are
+// protected, so the caller's bindings don't capture them.
+func (x *expansion) rename(a Atom) Atom {
+	switch {
+	case x.rule.bound[a]:
+		r, ok := x.renames[a]
+		if !ok {
+			r = gensym("-" + a.s)
+			x.renames[a] = r
+		}
+		return r
+	case a == True || isKeyword(a) || x.rules.literals[a]:
+		return a
+	case isSyntaxWord(a) && !specialFormNames[a]:
+		return a
+	}
+	return protected(a)
+}
+
+// syntaxWords are the names with special meanings to the compiler, which
+// are never bound to values.
+var syntaxWords = map[Atom]bool{}
+
+func init() {
+	for _, a := range []Atom{
+		symQuote, symSyntaxQuote, symTest, symCond, symAnd, symOr,
+		symLoop, symBlock, symReturnFrom, symSwallow, symDef, symDefvar,
+		symBinding, symSet, symDefn, symDefmacro, symDefsyntax, symDefmulti,
+		symDefmethod, symDelay, symGenerator, symFuture, symSelect,
+		symError, symErrors, symTry, symUnwindProtect, symLet, symLetfn,
+		symLambda, symCatch, symFinally, symUnquote, symSplicing,
+		symOptional, symKey, symArities, symDoc, symEllipsis,
+	} {
+		syntaxWords[a] = true
+	}
+}
+
+func isSyntaxWord(a Atom) bool {
+	return syntaxWords[a]
+}
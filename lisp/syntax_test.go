@@ -0,0 +1,57 @@
+package lisp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSyntaxRules(t *testing.T) {
+	var tests = []struct {
+		literals string
+		rule     string
+		args     string
+		out      string
+		err      string
+	}{
+		{"()", "((_ a b) '(b a))", "(1 2)", "(quote (2 1))", ""},
+		{"()", "((_ a ...) '(a ... 0))", "(1 2 3)", "(quote (1 2 3 0))", ""},
+		{"()", "((_ a ...) '(a ... 0))", "()", "(quote (0))", ""},
+		{"()", "((_ a b ... c) '(c b ... a))", "(1 2 3 4)", "(quote (4 2 3 1))", ""},
+		{"()", "((_ (a b) ...) '((a ...) (b ...)))", "((1 2) (3 4))", "(quote ((1 3) (2 4)))", ""},
+		{"()", "((_ a . b) 'b)", "(1 2 3)", "(quote (2 3))", ""},
+		{"()", "((_ _ b) 'b)", "(1 2)", "(quote 2)", ""},
+		{"()", "((_ a) '(... ...))", "(1)", "(quote ...)", ""},
+		{"(to)", "((_ a to b) '(a b))", "(1 to 2)", "(quote (1 2))", ""},
+		{"(to)", "((_ a to b) '(a b))", "(1 from 2)", "", "no syntax rule matches (m 1 from 2)"},
+		{"()", "((_ a b) '(b a))", "(1)", "", "tried ((_ a b))"},
+		{"()", "((_ (a b)) 'a)", "((1))", "", "no syntax rule matches"},
+		{"()", "((_ a ... b ...) 'a)", "()", "", "misplaced ... in pattern"},
+		{"()", "((_ a) a ...)", "()", "", "a syntax rule must be a (pattern template) pair"},
+		{"()", "(a a)", "()", "", "pattern must be a list"},
+		{"(1)", "((_ a) a)", "()", "", "literal '1' is not an atom"},
+	}
+	for _, test := range tests {
+		exprs, err := lexAndParse(strings.Split(test.literals+" "+test.rule+" "+test.args, "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out Sexpr
+		rules, err := mkSyntaxRules(Intern("m"), exprs[0], exprs[1:2])
+		if err == nil {
+			out, err = rules.expand([]Sexpr{exprs[2]}, nil)
+		}
+		if err != nil {
+			if test.err == "" || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s on %s: got error %q, want %q", test.rule, test.args, err, test.err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("%s on %s: expected error %q, got none", test.rule, test.args, test.err)
+			continue
+		}
+		if out.String() != test.out {
+			t.Errorf("%s on %s: got %s, want %s", test.rule, test.args, out, test.out)
+		}
+	}
+}
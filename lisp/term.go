@@ -1,30 +1,40 @@
 package lisp
 
 import (
+	"sync"
+
 	"github.com/gdamore/tcell"
 	"github.com/mattn/go-runewidth"
 )
 
 // For now, there is a global screen object only visible to Go code, to avoid
 // leaking the screen object outside of the abstraction provided by this file.
-var screen tcell.Screen
+// screenMu guards it, since goroutines started by spawn may draw at once.
+var (
+	screen   tcell.Screen
+	screenMu sync.Mutex
+)
 
 func termStart() error {
-	var err error
+	screenMu.Lock()
+	defer screenMu.Unlock()
 	if screen != nil {
 		return baseError("screen already initialized")
 	}
-	screen, err = tcell.NewScreen()
+	s, err := tcell.NewScreen()
 	if err != nil {
 		return extendError("termStart NewScreen", err)
 	}
-	if err := screen.Init(); err != nil {
+	if err := s.Init(); err != nil {
 		return extendError("termStart Init", err)
 	}
+	screen = s
 	return nil
 }
 
 func termClear() error {
+	screenMu.Lock()
+	defer screenMu.Unlock()
 	if screen == nil {
 		return baseError("screen not initialized")
 	}
@@ -34,6 +44,8 @@ func termClear() error {
 }
 
 func termEnd() error {
+	screenMu.Lock()
+	defer screenMu.Unlock()
 	if screen == nil {
 		// Do nothing -- already ended / not initialized
 		return nil
@@ -44,6 +56,8 @@ func termEnd() error {
 }
 
 func termDrawText(x, y int, str string) error {
+	screenMu.Lock()
+	defer screenMu.Unlock()
 	if screen == nil {
 		return baseError("screen not initialized")
 	}
@@ -64,6 +78,8 @@ func termDrawText(x, y int, str string) error {
 }
 
 func termSize() (int, int, error) {
+	screenMu.Lock()
+	defer screenMu.Unlock()
 	if screen == nil {
 		return 0, 0, baseError("screen not initialized")
 	}
@@ -72,11 +88,16 @@ func termSize() (int, int, error) {
 }
 
 func termGetKey() (string, error) {
-	if screen == nil {
+	// Don't hold the lock while waiting for a key, so that other
+	// goroutines can draw in the meantime:
+	screenMu.Lock()
+	s := screen
+	screenMu.Unlock()
+	if s == nil {
 		return "", baseError("screen not initialized")
 	}
 	for {
-		ev := screen.PollEvent()
+		ev := s.PollEvent()
 		if ev == nil {
 			return "", nil
 		}
@@ -0,0 +1,129 @@
+package lisp
+
+// thread is the l1 code running on one goroutine: a VM, and the VMs nested
+// in it by Go code it calls (builtins calling l1 functions, forcing delays,
+// expanding macros and so on), which all run on the same Go stack.  Calls
+// in all of a thread's VMs count towards MaxRecursionDepth.
+type thread struct {
+	// The innermost VM running:
+	m *vm
+	// The environment last made by wrap:
+	wrapped *Env
+	// An error on its way out of nested VMs, as it left the last of them,
+	// and the number of function frames it had left so far (see vm.throw):
+	unwinding *ConsCell
+	unwound   int
+	// The values given to special variables by `binding`, innermost last:
+	dyn []dynBinding
+	// The limits of the evaluation the thread runs on behalf of, if any
+	// (see limitedThread):
+	lim *limits
+}
+
+// dynBinding is a value given by `binding` to a special variable of the
+// top-level environment top.
+type dynBinding struct {
+	top  *Env
+	name Atom
+	val  Sexpr
+}
+
+// threadOf returns the thread of the Go code handed e by wrap, or, for any
+// other environment (one passed in from outside the interpreter, say), a
+// new thread.  Go code which saves an environment for later must not pass
+// it here then, as by that time it may belong to another thread.
+func threadOf(e *Env) *thread {
+	if e != nil && e.th != nil {
+		return e.th
+	}
+	return &thread{}
+}
+
+// fork returns a new thread, for another goroutine, which starts out with
+// the bindings in force on this one, and is bound by the same limits.
+func (th *thread) fork() *thread {
+	return &thread{dyn: append([]dynBinding(nil), th.dyn...), lim: th.lim}
+}
+
+// binding returns the innermost binding in force of the special variable
+// name of top, or nil.
+func (th *thread) binding(top *Env, name Atom) *dynBinding {
+	for i := len(th.dyn) - 1; i >= 0; i-- {
+		if b := &th.dyn[i]; b.name == name && b.top == top {
+			return b
+		}
+	}
+	return nil
+}
+
+// wrap returns an environment standing for e, to hand to Go code called
+// from the thread's innermost VM, through which any VMs that code starts
+// find the thread: e itself, if the thread made it.
+func (th *thread) wrap(e *Env) *Env {
+	if e.th == th {
+		return e
+	}
+	if th.wrapped == nil || th.wrapped.parent != e {
+		th.wrapped = &Env{parent: e, th: th}
+	}
+	return th.wrapped
+}
+
+// run runs m, nested in the thread's innermost VM, if any.  Bindings m
+// leaves in force, because it was stopped part way through a `binding`
+// body, are undone, unless it yielded (see generator.resume).
+func (th *thread) run(m *vm) (Sexpr, error) {
+	outer, n := th.m, len(th.dyn)
+	if outer != nil {
+		m.depth = outer.depth + len(outer.frames)
+	}
+	m.th, th.m, m.lim = th, m, th.lim
+	defer func() { th.m = outer }()
+	x, err := m.run()
+	if _, ok := err.(*genYield); !ok && len(th.dyn) > n {
+		th.dyn = th.dyn[:n]
+	}
+	return x, err
+}
+
+// execute runs compiled code in the given environment, in a VM nested in
+// the thread's innermost one, if any.
+func (th *thread) execute(c *code, e *Env) (Sexpr, error) {
+	return th.run(&vm{frames: []frame{{code: c, env: e}}})
+}
+
+// call applies a function to already-evaluated arguments, in a VM nested in
+// the thread's innermost one.
+func (th *thread) call(fn Sexpr, args []Sexpr, e *Env) (Sexpr, error) {
+	c := &code{
+		instrs: []instr{{opCall, 0}, {opReturn, 0}},
+		calls:  []callSite{{nargs: len(args)}},
+	}
+	m := &vm{frames: []frame{{code: c, env: e}}, nested: true}
+	m.push(fn)
+	m.stack = append(m.stack, args...)
+	return th.run(m)
+}
+
+// unwoundSoFar returns the number of function frames err has left in nested
+// VMs, if it is the error last thrown out of one, or has had context added
+// to it since by Go code.  Once the error's trace has as many frames as are
+// shown, that context is dropped too, lest an error from deeply nested VMs
+// grow without bound.
+func (th *thread) unwoundSoFar(err error) (error, int) {
+	l, ok := err.(*ConsCell)
+	if !ok || th.unwinding == nil {
+		return err, 0
+	}
+	defer func() { th.unwinding = nil }()
+	for x := l; x != Nil; x, _ = x.cdr.(*ConsCell) {
+		if x != th.unwinding {
+			continue
+		}
+		if th.unwound >= maxTraceFrames {
+			return x, th.unwound
+		}
+		return err, th.unwound
+	}
+	return err, 0
+}
@@ -15,6 +15,12 @@ func mkListAsConsWithCdr(xs []Sexpr, cdr Sexpr) Sexpr {
 }
 
 func consToExprs(argList Sexpr) ([]Sexpr, error) {
+	return consToExprsIn(argList, nil)
+}
+
+// consToExprsIn is consToExprs for Go code handed e, on whose behalf the
+// tails of lazy sequences are forced (see forceTail).
+func consToExprsIn(argList Sexpr, e *Env) ([]Sexpr, error) {
 	args := []Sexpr{}
 	for argList != Nil {
 		cons, ok := argList.(*ConsCell)
@@ -22,7 +28,11 @@ func consToExprs(argList Sexpr) ([]Sexpr, error) {
 			return nil, baseErrorf("expected list, got %q", argList)
 		}
 		args = append(args, cons.car)
-		argList = cons.cdr
+		tail, err := forceTail(cons.cdr, e)
+		if err != nil {
+			return nil, err
+		}
+		argList = tail
 	}
 	return args, nil
 }
@@ -48,7 +58,7 @@ func convertStringToDoc(s string) *ConsCell {
 func stringsToList(listElems ...string) *ConsCell {
 	xs := make([]Sexpr, len(listElems))
 	for i, s := range listElems {
-		xs[i] = Atom{s}
+		xs[i] = Intern(s)
 	}
 	return list(xs...)
 }
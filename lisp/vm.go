@@ -0,0 +1,920 @@
+package lisp
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// opcode identifies a single VM instruction.
+type opcode uint8
+
+const (
+	opConst       opcode = iota // push consts[arg]
+	opNil                       // push ()
+	opTrue                      // push t
+	opLookup                    // push the value of the symbol consts[arg]
+	opLocal                     // push the value of the local variable refs[arg]
+	opGlobal                    // push the global value of the symbol consts[arg]
+	opPop                       // discard the top of the stack
+	opSetTop                    // pop a value, overwriting the new top with it
+	opJump                      // jump to arg
+	opJumpIfNil                 // pop; jump to arg if the value was ()
+	opJumpIfTrue                // jump to arg if top is not (), else pop it
+	opMacroGuard                // expand calls[arg] if the function is a macro
+	opMacroCheck                // recompile macros[arg] if the macro has changed
+	opCall                      // call a function, as described by calls[arg]
+	opTailCall                  // ... reusing the current frame
+	opReturn                    // return the top of the stack to the caller
+	opLambda                    // push a closure over the template consts[arg]
+	opDef                       // bind consts[arg] in the top-level env
+	opDefvar                    // ... and declare it a special variable
+	opDefn                      // pop a function, bind it at top level, push ()
+	opSet                       // update the nearest binding of consts[arg]
+	opSetLocal                  // update the local variable refs[arg]
+	opLet                       // pop values into a new env, as per lets[arg]
+	opUnsupplied                // push t if local slot arg is empty, else ()
+	opDestructure               // pop x, push the values matching pattern consts[arg]
+	opPopEnv                    // return to the parent of the current env
+	opRaise                     // pop x and raise the error (x)
+	opRethrow                   // pop an error list and raise it unchanged
+	opFail                      // raise the error list consts[arg]
+	opPushHandler               // on error, unwind to here and jump to arg
+	opPopHandler                // discard the innermost handler
+	opBlock                     // push a handler for the block blocks[arg]
+	opReturnFrom                // pop x and return it from the block consts[arg]
+	opPushCleanup               // on any exit, unwind to here and jump to arg
+	opEndCleanup                // pop an unwinding and continue it
+	opBind                      // pop values for the specials consts[arg], bind them on the thread
+	opUnbind                    // undo the bindings of the specials consts[arg] on the thread
+	opErrorsSig                 // check the `errors` signature on top of stack
+	opErrorsMatch               // compare a caught error to the signature below it
+	opTestBegin                 // pop and announce a test description
+	opTestStep                  // mark the completion of a test expression
+	opTestEnd                   // mark the completion of a test
+)
+
+type instr struct {
+	op  opcode
+	arg int
+}
+
+// callSite describes a function call: how many arguments were pushed, the
+// source form (needed if the function turns out to be a macro at run time),
+// and where execution resumes after the call.
+type callSite struct {
+	nargs int
+	form  *ConsCell
+	tail  bool
+	next  int
+	scope *scope
+}
+
+// macroUse records a macro call expanded at compile time, so that the
+// expansion can be abandoned if the macro is redefined before the code runs.
+type macroUse struct {
+	name  Atom
+	fn    *lambdaFn
+	form  *ConsCell
+	tail  bool
+	next  int
+	scope *scope
+}
+
+// blockInfo describes a named block: its name, and where it ends.
+type blockInfo struct {
+	name Atom
+	end  int
+}
+
+// varRef is the lexical address of a local variable: the number of
+// environments to go up, and the slot within that environment.
+type varRef struct {
+	name  Atom
+	depth int
+	slot  int
+}
+
+// letInfo describes a new local environment: how many values to pop into
+// its first slots, and its scope.
+type letInfo struct {
+	n     int
+	scope *scope
+}
+
+// formSpan records which body expression of a lambda starts at pc, for use
+// in stacktraces.
+type formSpan struct {
+	pc   int
+	form Sexpr
+}
+
+// code is the compiled form of an expression or of a lambda body.
+type code struct {
+	instrs []instr
+	consts []Sexpr
+	calls  []callSite
+	refs   []varRef
+	lets   []letInfo
+	macros []macroUse
+	blocks []blockInfo
+	forms  []formSpan
+	// The value of macroGen when the code was compiled:
+	gen int64
+	// The scope of the code's environment, and whether it is rooted in the
+	// top-level environment (see compiler):
+	scope  *scope
+	rooted bool
+	// For a lambda with several arities, the code for each, in the order
+	// of lambdaFn.arities:
+	arities []*code
+}
+
+func (c *code) formAt(pc int) Sexpr {
+	for i := len(c.forms) - 1; i >= 0; i-- {
+		if c.forms[i].pc <= pc {
+			return c.forms[i].form
+		}
+	}
+	return Nil
+}
+
+type frame struct {
+	code *code
+	pc   int
+	env  *Env
+	// Stack index of the called function; the frame's result replaces it.
+	base int
+	// The function being run, or nil for top-level (or macro-expanded) code:
+	fn *lambdaFn
+	// For other code, any context to add to errors unwinding through it:
+	trace *ConsCell
+}
+
+type handlerKind int
+
+const (
+	catchHandler   handlerKind = iota // try, swallow, errors
+	blockHandler                      // block, and the loop forms
+	cleanupHandler                    // finally, unwind-protect
+)
+
+// handler marks a point to which control can return non-locally: an error
+// handler, the end of a block, or cleanup code.
+type handler struct {
+	kind   handlerKind
+	name   Atom // for blocks
+	frames int
+	sp     int
+	env    *Env
+	pc     int
+}
+
+// vm is a stack machine which runs compiled code.  l1 function calls push
+// frames onto the VM's own stack rather than recursing in Go.
+type vm struct {
+	stack    []Sexpr
+	frames   []frame
+	handlers []handler
+	// True while the VM is running:
+	live bool
+	// True if the VM was started by Go code called from another VM:
+	nested bool
+	// Limits on the evaluation, or nil:
+	lim *limits
+	// The generator whose body the VM runs, or nil:
+	gen *generator
+	// The thread the VM runs on, and the number of frames in the VMs it
+	// is nested in there:
+	th    *thread
+	depth int
+}
+
+func (m *vm) push(x Sexpr) {
+	m.stack = append(m.stack, x)
+}
+
+func (m *vm) pop() Sexpr {
+	x := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return x
+}
+
+func (m *vm) top() Sexpr {
+	return m.stack[len(m.stack)-1]
+}
+
+// unwinding is delivered to cleanup code (see opPushCleanup), recording the
+// non-local exit to continue once the cleanup forms have run: an error, a
+// blockExit or a contInvoke.  normalExit marks a normal exit.
+type unwinding struct {
+	exit error
+}
+
+var normalExit = &unwinding{}
+
+func (u *unwinding) String() string {
+	return "<unwinding>"
+}
+
+func (u *unwinding) Equal(o Sexpr) bool {
+	return false
+}
+
+// cleanupAbove returns the index of the innermost cleanup handler at or above
+// index floor, or -1 if there is none.
+func (m *vm) cleanupAbove(floor int) int {
+	for i := len(m.handlers) - 1; i >= floor; i-- {
+		if m.handlers[i].kind == cleanupHandler {
+			return i
+		}
+	}
+	return -1
+}
+
+// throw unwinds to the innermost error or cleanup handler, adding context to
+// the error for the innermost few function frames it leaves, counting those
+// left in any VMs nested in this one on the way.  If there is no handler, the
+// (extended) error is returned.
+//
+// Once the evaluation has been stopped (see limits), errors can't be caught,
+// and errors raised by cleanup code give way to the one which stopped it.
+func (m *vm) throw(err error) error {
+	stopping := m.lim.stopping()
+	if stopping && !sameCause(errorList(err), m.lim.err.(*ConsCell)) {
+		err = m.lim.err
+	}
+	i := len(m.handlers) - 1
+	for i >= 0 && (m.handlers[i].kind == blockHandler ||
+		stopping && m.handlers[i].kind == catchHandler) {
+		i--
+	}
+	floor := 0
+	if i >= 0 {
+		floor = m.handlers[i].frames
+	}
+	err, n := m.th.unwoundSoFar(err)
+	for len(m.frames) > floor {
+		f := m.frames[len(m.frames)-1]
+		if f.fn != nil {
+			if n < maxTraceFrames {
+				err = extendWithList(list(Intern("lambda"), f.code.formAt(f.pc-1)), err)
+			}
+			n++
+		} else if f.trace != nil && n < maxTraceFrames {
+			err = extendWithList(f.trace, err)
+		}
+		m.frames = m.frames[:len(m.frames)-1]
+	}
+	if i < 0 && m.depth > 0 {
+		// The error goes on into the VM this one is nested in:
+		m.th.unwinding, _ = err.(*ConsCell)
+		m.th.unwound = n
+	} else if n > maxTraceFrames {
+		err = extendError(fmt.Sprintf("%d more frames", n-maxTraceFrames), err)
+	}
+	if i < 0 {
+		m.handlers = m.handlers[:0]
+		m.stack = m.stack[:0]
+		return err
+	}
+	if m.handlers[i].kind == cleanupHandler {
+		m.unwind(i, &unwinding{err})
+	} else {
+		m.unwind(i, err.(*ConsCell))
+	}
+	return nil
+}
+
+// unwind transfers control to handler i, delivering x to it.
+func (m *vm) unwind(i int, x Sexpr) {
+	h := m.handlers[i]
+	m.handlers = m.handlers[:i]
+	m.frames = m.frames[:h.frames]
+	f := &m.frames[len(m.frames)-1]
+	f.env = h.env
+	f.pc = h.pc
+	m.stack = m.stack[:h.sp]
+	m.push(x)
+}
+
+// returnFrom returns x from the innermost active block with the given name,
+// first running any cleanup code on the way.  If there is no such block, and
+// the VM was started from inside another VM, the search continues there.
+func (m *vm) returnFrom(name Atom, x Sexpr) error {
+	i := len(m.handlers) - 1
+	for i >= 0 && (m.handlers[i].kind != blockHandler || m.handlers[i].name != name) {
+		i--
+	}
+	if c := m.cleanupAbove(i + 1); c >= 0 && (i >= 0 || m.nested) {
+		m.unwind(c, &unwinding{&blockExit{name, x}})
+		return nil
+	}
+	if i >= 0 {
+		m.unwind(i, x)
+		return nil
+	}
+	if m.nested {
+		return &blockExit{name, x}
+	}
+	return baseErrorf("return-from: no enclosing block named %s", name)
+}
+
+// blockExit is returned, in place of an error, when returning from a block
+// which belongs to an enclosing VM.  Like contInvoke, it is invisible to
+// error handlers.
+type blockExit struct {
+	name Atom
+	val  Sexpr
+}
+
+func (be *blockExit) Error() string {
+	return fmt.Sprintf("return from block %s", be.name)
+}
+
+// currentCode returns a function's code, first recompiling it if macros
+// have changed since it was compiled.  Goroutines may share the function,
+// so its code is read and replaced atomically; goroutines recompiling it at
+// once produce the same code.
+func (fn *lambdaFn) currentCode() *code {
+	p := (*unsafe.Pointer)(unsafe.Pointer(&fn.code))
+	c := (*code)(atomic.LoadPointer(p))
+	if c.gen != macroGeneration() {
+		c = compileLambda(fn, fn.env, c.scope.parent, c.rooted)
+		atomic.StorePointer(p, unsafe.Pointer(c))
+	}
+	return c
+}
+
+// enter binds a lambda's arguments and pushes (or, for tail calls, reuses) a
+// frame to run its body.
+func (m *vm) enter(fn *lambdaFn, base int, args []Sexpr, tail bool) error {
+	c := fn.currentCode()
+	if fn.arities != nil {
+		i := fn.arity(len(args))
+		if i < 0 {
+			return extendError("lambda env setup",
+				arityError("wrong number of arguments for", fn, len(args)))
+		}
+		// Run the chosen body as if it were the function itself:
+		withBody := *fn.arities[i]
+		withBody.env, withBody.defName, withBody.name = fn.env, fn.defName, fn.name
+		withBody.code = c.arities[i]
+		fn, c = &withBody, withBody.code
+	}
+	newEnv := mkSlotEnv(fn.env, c.scope.names)
+	newEnv.th = m.th
+	if err := setLambdaArgs(newEnv.vals, fn, args); err != nil {
+		return extendError("lambda env setup", err)
+	}
+	m.stack = m.stack[:base]
+	if tail {
+		f := &m.frames[len(m.frames)-1]
+		m.stack = m.stack[:f.base]
+		*f = frame{code: c, env: newEnv, base: f.base, fn: fn}
+		return nil
+	}
+	return m.pushFrame(frame{code: c, env: newEnv, base: base, fn: fn})
+}
+
+// MaxRecursionDepth is the maximum number of nested (non-tail) function
+// calls, including those in VMs nested in one another (see thread); calls
+// beyond it raise an error.  Zero, the default, means no limit.
+var MaxRecursionDepth = 0
+
+// How many function frames an error's stacktrace shows as it unwinds:
+const maxTraceFrames = 10
+
+// pushFrame starts running a new frame, unless doing so would exceed the
+// maximum recursion depth.
+func (m *vm) pushFrame(f frame) error {
+	if MaxRecursionDepth > 0 && m.depth+len(m.frames) >= MaxRecursionDepth {
+		return baseError("maximum recursion depth exceeded")
+	}
+	m.frames = append(m.frames, f)
+	return nil
+}
+
+// call applies the function at stack[base] to the arguments above it.
+func (m *vm) call(base int, tail bool) error {
+	callee := m.stack[base]
+	args := m.stack[base+1:]
+	switch fn := callee.(type) {
+	case *lambdaFn:
+		return m.enter(fn, base, args, tail)
+	case *Builtin:
+		if fn.ctl != nil {
+			if err := fn.ctl(m, base, tail); err != nil {
+				return extendError(fmt.Sprintf("builtin function %s", fn.Name), err)
+			}
+			return nil
+		}
+		env := m.th.wrap(m.frames[len(m.frames)-1].env)
+		res, err := fn.Fn(append(make([]Sexpr, 0, len(args)), args...), env)
+		if err != nil {
+			return extendError(fmt.Sprintf("builtin function %s", fn.Name), err)
+		}
+		m.stack = m.stack[:base]
+		if tail {
+			m.ret(res)
+			return nil
+		}
+		m.push(res)
+		return nil
+	case *multiFn:
+		method, err := fn.method(append(make([]Sexpr, 0, len(args)), args...), m.th.wrap(m.frames[len(m.frames)-1].env))
+		if err != nil {
+			return err
+		}
+		m.stack[base] = method
+		return m.call(base, tail)
+	case *continuation:
+		switch len(args) {
+		case 0:
+			return &contInvoke{fn, Nil}
+		case 1:
+			return &contInvoke{fn, args[0]}
+		default:
+			return baseError("a continuation takes at most one argument")
+		}
+	default:
+		return baseErrorf("%s is not a function", callee)
+	}
+}
+
+// ret pops the current frame, delivering its result to the caller's stack.
+func (m *vm) ret(x Sexpr) {
+	f := m.frames[len(m.frames)-1]
+	m.frames = m.frames[:len(m.frames)-1]
+	m.stack = m.stack[:f.base]
+	m.push(x)
+}
+
+// run executes frames until none are left, returning the result of the
+// outermost one.
+func (m *vm) run() (Sexpr, error) {
+	m.live = true
+	defer func() { m.live = false }()
+	for {
+		if len(m.frames) == 0 {
+			return m.pop(), nil
+		}
+		if m.lim != nil {
+			if err := m.lim.step(); err != nil {
+				if err = m.throw(err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		f := &m.frames[len(m.frames)-1]
+		in := f.code.instrs[f.pc]
+		f.pc++
+		var err error
+		switch in.op {
+		case opConst:
+			m.push(f.code.consts[in.arg])
+		case opNil:
+			m.push(Nil)
+		case opTrue:
+			m.push(True)
+		case opLookup:
+			a := f.code.consts[in.arg].(Atom)
+			if b := m.binding(a, f.env); b != nil {
+				m.push(b.val)
+				break
+			}
+			var x Sexpr
+			x, err = lookup(a, f.env)
+			if err == nil {
+				m.push(x)
+			}
+		case opLocal:
+			ref := f.code.refs[in.arg]
+			e := f.env
+			for d := ref.depth; d > 0; d-- {
+				e = e.parent
+			}
+			if x := e.vals[ref.slot]; x != nil {
+				m.push(x)
+				break
+			}
+			// A slot not yet filled in, e.g. by letfn:
+			var x Sexpr
+			x, err = lookupGlobal(ref.name, f.env)
+			if err == nil {
+				m.push(x)
+			}
+		case opGlobal:
+			a := f.code.consts[in.arg].(Atom)
+			if len(m.th.dyn) > 0 {
+				if b := m.th.binding(f.env.top(), a); b != nil {
+					m.push(b.val)
+					break
+				}
+			}
+			var x Sexpr
+			x, err = lookupGlobal(a, f.env)
+			if err == nil {
+				m.push(x)
+			}
+		case opPop:
+			m.pop()
+		case opSetTop:
+			x := m.pop()
+			m.stack[len(m.stack)-1] = x
+		case opJump:
+			f.pc = in.arg
+		case opJumpIfNil:
+			if m.pop() == Nil {
+				f.pc = in.arg
+			}
+		case opJumpIfTrue:
+			if m.top() != Nil {
+				f.pc = in.arg
+			} else {
+				m.pop()
+			}
+		case opMacroGuard:
+			err = m.macroGuard(f, f.code.calls[in.arg])
+		case opMacroCheck:
+			if f.code.gen != macroGeneration() {
+				mu := f.code.macros[in.arg]
+				if x, _ := lookupHead(mu.name, f.env); x != Sexpr(mu.fn) {
+					m.inline(f, mu.form, mu.scope, mu.tail, mu.next)
+				}
+			}
+		case opCall, opTailCall:
+			cs := f.code.calls[in.arg]
+			err = m.call(len(m.stack)-cs.nargs-1, in.op == opTailCall)
+		case opReturn:
+			m.ret(m.pop())
+		case opLambda:
+			m.push(closure(f.code.consts[in.arg].(*lambdaFn), f.env))
+		case opDef:
+			noteBinding(f.env, f.code.consts[in.arg].(Atom), m.top())
+			err = f.env.setTopLevel(f.code.consts[in.arg].(Atom), m.top())
+			if err != nil {
+				err = extendError("setting def result", err)
+			}
+		case opDefvar:
+			name := f.code.consts[in.arg].(Atom)
+			noteBinding(f.env, name, m.top())
+			if err = f.env.setTopLevel(name, m.top()); err != nil {
+				err = extendError("setting defvar result", err)
+			} else {
+				f.env.top().declareSpecial(name)
+			}
+		case opDefn:
+			name := f.code.consts[in.arg].(Atom)
+			fn := m.pop()
+			if l, ok := fn.(*lambdaFn); ok && l.defName == noName {
+				l.defName = name
+			}
+			noteBinding(f.env, name, fn)
+			err = f.env.setTopLevel(name, fn)
+			if err != nil {
+				err = extendError("setting defn result", err)
+			}
+			m.push(Nil)
+		case opSet:
+			a := f.code.consts[in.arg].(Atom)
+			if b := m.binding(a, f.env); b != nil {
+				b.val = m.top()
+				break
+			}
+			noteBinding(f.env, a, m.top())
+			err = f.env.update(a, m.top())
+			if err != nil {
+				err = extendError("updating set result", err)
+			}
+		case opSetLocal:
+			ref := f.code.refs[in.arg]
+			e := f.env
+			for d := ref.depth; d > 0; d-- {
+				e = e.parent
+			}
+			e.vals[ref.slot] = m.top()
+		case opUnsupplied:
+			if f.env.vals[in.arg] == nil {
+				m.push(True)
+			} else {
+				m.push(Nil)
+			}
+		case opDestructure:
+			var stack []Sexpr
+			x := m.pop()
+			if stack, err = destructure(f.code.consts[in.arg], x, m.stack); err == nil {
+				m.stack = stack
+			}
+		case opLet:
+			li := f.code.lets[in.arg]
+			newEnv := mkSlotEnv(f.env, li.scope.names)
+			newEnv.th = m.th
+			copy(newEnv.vals, m.stack[len(m.stack)-li.n:])
+			m.stack = m.stack[:len(m.stack)-li.n]
+			f.env = newEnv
+		case opPopEnv:
+			f.env = f.env.parent
+		case opRaise:
+			err = Cons(m.pop(), Nil)
+		case opRethrow:
+			err = m.pop().(*ConsCell)
+		case opFail:
+			err = f.code.consts[in.arg].(*ConsCell)
+		case opPushHandler:
+			m.handlers = append(m.handlers, handler{
+				kind:   catchHandler,
+				frames: len(m.frames),
+				sp:     len(m.stack),
+				env:    f.env,
+				pc:     in.arg,
+			})
+		case opPopHandler:
+			m.handlers = m.handlers[:len(m.handlers)-1]
+		case opBlock:
+			b := f.code.blocks[in.arg]
+			m.handlers = append(m.handlers, handler{
+				kind:   blockHandler,
+				name:   b.name,
+				frames: len(m.frames),
+				sp:     len(m.stack),
+				env:    f.env,
+				pc:     b.end,
+			})
+		case opReturnFrom:
+			err = m.returnFrom(f.code.consts[in.arg].(Atom), m.pop())
+		case opPushCleanup:
+			m.handlers = append(m.handlers, handler{
+				kind:   cleanupHandler,
+				frames: len(m.frames),
+				sp:     len(m.stack),
+				env:    f.env,
+				pc:     in.arg,
+			})
+		case opEndCleanup:
+			err = m.pop().(*unwinding).exit
+		case opBind:
+			names := f.code.consts[in.arg].(*ConsCell)
+			err = m.bind(f.env, names)
+		case opUnbind:
+			names := f.code.consts[in.arg].(*ConsCell)
+			m.unbind(names)
+		case opErrorsSig:
+			if _, ok := m.top().(*ConsCell); !ok {
+				err = baseError("error signature must be a list")
+			}
+		case opErrorsMatch:
+			caught := m.pop().(*ConsCell)
+			errorStr := unwrapList(m.pop().(*ConsCell))
+			if strings.Contains(caught.Error(), errorStr) {
+				m.push(Nil)
+			} else {
+				err = baseErrorf("error '%s' not found in '%s'",
+					errorStr, caught.Error())
+			}
+		case opTestBegin:
+			fmt.Printf("TEST %s ", m.pop())
+		case opTestStep:
+			fmt.Print(".")
+		case opTestEnd:
+			fmt.Println("✓")
+		default:
+			panic(fmt.Sprintf("unknown opcode %d", in.op))
+		}
+		if err == nil {
+			continue
+		}
+		switch t := err.(type) {
+		case *contInvoke:
+			// Cleanup code for everything the continuation leaves runs
+			// first:
+			if c := m.cleanupAbove(m.sharedHandlers(t.k)); c >= 0 {
+				m.unwind(c, &unwinding{t})
+				break
+			}
+			// A continuation whose VM has finished is resumed here, in
+			// place of whatever this VM was doing:
+			if t.k.m != m && t.k.m.live {
+				return nil, t
+			}
+			m.resume(t.k, t.val)
+		case *genYield:
+			// The generator's VM stops here until it is resumed:
+			return nil, t
+		case *blockExit:
+			// The block may belong to this VM, or to an enclosing one:
+			if err = m.returnFrom(t.name, t.val); err != nil {
+				if _, ok := err.(*blockExit); ok {
+					return nil, err
+				}
+				if err = m.throw(errorList(err)); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			if err = m.throw(errorList(err)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// bind gives the special variables named in names the values on top of
+// the stack, on the VM's thread, until unbind.
+func (m *vm) bind(e *Env, names *ConsCell) error {
+	atoms, _ := consToExprs(names)
+	top := e.top()
+	for _, name := range atoms {
+		if !top.isSpecial(name.(Atom)) {
+			return baseErrorf("%s is not a special variable", name)
+		}
+	}
+	vals := m.stack[len(m.stack)-len(atoms):]
+	for i, name := range atoms {
+		m.th.dyn = append(m.th.dyn, dynBinding{top, name.(Atom), vals[i]})
+	}
+	m.stack = m.stack[:len(m.stack)-len(atoms)]
+	return nil
+}
+
+// unbind undoes the bindings of the special variables in names made by
+// bind.
+func (m *vm) unbind(names *ConsCell) {
+	atoms, _ := consToExprs(names)
+	n := len(m.th.dyn) - len(atoms)
+	if n < 0 {
+		n = 0
+	}
+	for i := range m.th.dyn[n:] {
+		m.th.dyn[n+i] = dynBinding{}
+	}
+	m.th.dyn = m.th.dyn[:n]
+}
+
+// binding returns the innermost binding in force on the VM's thread of the
+// special variable a, unless a is bound locally in e, or nil.
+func (m *vm) binding(a Atom, e *Env) *dynBinding {
+	if len(m.th.dyn) == 0 || e.bindsLocally(a) {
+		return nil
+	}
+	return m.th.binding(e.top(), a)
+}
+
+// macroGuard handles calls whose function was not known to be a macro when
+// the call was compiled (e.g. a macro defined later in the same top-level
+// form): if the function on top of the stack is a macro, the call's source
+// form is expanded and run in place of the call.
+func (m *vm) macroGuard(f *frame, cs callSite) error {
+	fn, ok := m.top().(*lambdaFn)
+	if !ok || !fn.isMacro {
+		return nil
+	}
+	m.pop()
+	expanded, err := macroexpand(cs.form, m.th.wrap(f.env))
+	if err != nil {
+		return extendError("eval macroexpansion", err)
+	}
+	m.inline(f, expanded, cs.scope, cs.tail, cs.next)
+	return nil
+}
+
+// inline compiles x and runs it in place of the code in f which would have
+// continued at f.pc, resuming at next afterwards.
+func (m *vm) inline(f *frame, x Sexpr, s *scope, tail bool, next int) {
+	c := compileScoped(x, m.th.wrap(f.env), s, f.code.rooted)
+	if tail {
+		m.stack = m.stack[:f.base]
+		f.code, f.pc = c, 0
+		return
+	}
+	f.pc = next
+	m.frames = append(m.frames, frame{code: c, env: f.env, base: len(m.stack)})
+}
+
+func isMacro(x Sexpr) bool {
+	fn, ok := x.(*lambdaFn)
+	return ok && fn.isMacro
+}
+
+// noteBinding invalidates compiled code if binding name to x would define,
+// redefine or hide a macro.
+func noteBinding(e *Env, name Atom, x Sexpr) {
+	if old, _ := e.lookup(name); isMacro(x) || isMacro(old) {
+		atomic.AddInt64(&macroGen, 1)
+	}
+}
+
+// closure makes a function from a compiled lambda template, closing over
+// the given environment.
+func closure(tmpl *lambdaFn, e *Env) *lambdaFn {
+	fn := *tmpl
+	fn.env = e
+	if fn.name != noName {
+		// A named lambda can invoke itself by name, without the name
+		// being visible outside it:
+		fn.env = mkSlotEnv(e, []Atom{fn.name})
+		fn.env.vals[0] = &fn
+	}
+	return &fn
+}
+
+func lookup(a Atom, e *Env) (Sexpr, error) {
+	ret, ok := e.lookup(a)
+	if ok {
+		return ret, nil
+	}
+	ret, ok = builtinAtoms[a]
+	if ok {
+		return ret, nil
+	}
+	return nil, baseErrorf("unknown symbol: %s", a.s)
+}
+
+// lookupGlobal looks up a name in the top-level environment, or failing
+// that, the builtins.
+func lookupGlobal(s Atom, e *Env) (Sexpr, error) {
+	ret, ok := e.top().getTopLevel(s)
+	if ok {
+		return ret, nil
+	}
+	ret, ok = builtinAtoms[s]
+	if ok {
+		return ret, nil
+	}
+	return nil, baseErrorf("unknown symbol: %s", s)
+}
+
+// execute runs compiled code in the given environment, on the thread of e
+// (see threadOf).
+func execute(c *code, e *Env) (Sexpr, error) {
+	return threadOf(e).execute(c, e)
+}
+
+// callFn applies a function to already-evaluated arguments.  It is the way
+// into the VM for Go code (e.g. builtins) which needs to call l1 functions;
+// given the environment handed to a builtin, the call runs on the caller's
+// thread.
+func callFn(fn Sexpr, args []Sexpr, e *Env) (Sexpr, error) {
+	return threadOf(e).call(fn, args, e)
+}
+
+// applyCtl calls a function with the arguments given in its last argument,
+// a list, preceded by any others: (apply f a b l).  A call to apply in tail
+// position makes a tail call to the function.
+func applyCtl(m *vm, base int, tail bool) error {
+	args := m.stack[base+1:]
+	if len(args) < 2 {
+		return baseError("apply: not enough arguments")
+	}
+	c, ok := args[len(args)-1].(*ConsCell)
+	if !ok {
+		return baseErrorf("'%s' is not a list", args[len(args)-1])
+	}
+	asCons, err := consToExprsIn(c, m.th.wrap(m.frames[len(m.frames)-1].env))
+	if err != nil {
+		return extendError("apply", err)
+	}
+	fnArgs := append([]Sexpr{}, args[:len(args)-1]...)
+	m.stack = append(append(m.stack[:base], fnArgs...), asCons...)
+	return m.call(base, tail)
+}
+
+// evalCtl compiles its first argument in the environment given as its
+// second, or failing that the caller's, and runs it in a new frame.
+func evalCtl(m *vm, base int, tail bool) error {
+	e := m.frames[len(m.frames)-1].env
+	switch len(m.stack) - base {
+	case 1:
+		return baseError("missing argument")
+	case 2:
+	case 3:
+		env, ok := m.stack[base+2].(*Env)
+		if !ok {
+			return baseErrorf("'%s' is not an environment", m.stack[base+2])
+		}
+		e = env
+	default:
+		return baseError("too many arguments")
+	}
+	c := compileScoped(m.stack[base+1], m.th.wrap(e), nil, e.parent == nil)
+	m.stack = m.stack[:base]
+	return m.pushFrame(frame{code: c, env: e, base: base,
+		trace: list(Intern("builtin"), Intern("function"), Intern("eval"))})
+}
+
+// theEnvironmentCtl returns the caller's environment.
+func theEnvironmentCtl(m *vm, base int, tail bool) error {
+	if len(m.stack)-base != 1 {
+		return baseError("too many arguments")
+	}
+	e := m.frames[len(m.frames)-1].env
+	m.stack = m.stack[:base]
+	if tail {
+		m.ret(e)
+		return nil
+	}
+	m.push(e)
+	return nil
+}
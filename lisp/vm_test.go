@@ -0,0 +1,234 @@
+package lisp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVM(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore, &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		out string
+		err string
+	}{
+		// Macros defined in the same form they're used in:
+		{"((lambda () (defmacro m1 (x) `(+ 1 ~x)) (m1 2)))", "3", ""},
+		// Expanding and inspecting expansions:
+		{"(macroexpand-all '(lambda (x) (m1 x)))", "(lambda (x) (+ 1 x))", ""},
+		{"(macroexpand-trace '(m1 2))", "((m1 2) (+ 1 2))", ""},
+		// Auto-gensyms and protected names in syntax-quote:
+		{"(defmacro m4 (x) `(let ((y# ~x)) (+ y# y#)))", "()", ""},
+		{"(let ((y 2) (+ -)) (m4 y))", "4", ""},
+		{"(let ((f (lambda () `(a# a#)))) (= (car (f)) (car (f))))", "()", ""},
+		// Nested syntax-quotes:
+		{"(let ((x 1)) `(a `(b ~(c ~x))))", "(a (syntax-quote (b (unquote (c 1)))))", ""},
+		{"(let ((x '(1 2))) `(a ~@x . b))", "(a 1 2 . b)", ""},
+		{"`(a (unquote))", "", "unquote requires exactly one argument"},
+		// Pattern-based macros:
+		{"(defsyntax m5 () ((_ x y ...) (list y ... x)))", "()", ""},
+		{"(m5 1 2 3)", "(2 3 1)", ""},
+		{"(m5)", "", "no syntax rule matches (m5) tried ((_ x y ...))"},
+		// Multimethods:
+		{"(defmulti mm1 car)", "()", ""},
+		{"(defmethod mm1 'a (x) (cadr x))", "()", ""},
+		{"(mm1 '(a 3))", "3", ""},
+		{"mm1", "<multimethod mm1>", ""},
+		{"(mm1 '(b 3))", "", "no method in multimethod mm1 for dispatch value b"},
+		// Delays:
+		{"(delay 1)", "<delay>", ""},
+		{"(let ((n 0)) (let ((d (delay (set! n (+ n 1)) n))) (force d) (force d)))", "1", ""},
+		{"(cons 1 (delay (cons 2 (delay ()))))", "(1 ...)", ""},
+		{"(let ((l (cons 1 (delay (cons 2 (delay ())))))) (len l) l)", "(1 2)", ""},
+		{"(cdr (cons 1 (delay '(2 3))))", "(2 3)", ""},
+		{"(len (cons 1 (delay 2)))", "", "is not a list"},
+		{"(def rd (delay (force rd)))", "<delay>", ""},
+		{"(force rd)", "", "(builtin function force) (delay forced recursively)"},
+		{"(force rd)", "", "(delay forced recursively)"},
+		{"(def rs (lazy-cons 1 (+ rs 1)))", "(1 ...)", ""},
+		{"(cdr rs)", "", "(expected number, got '(1 ...)')"},
+		// Generators:
+		{"(generator (yield 1))", "<generator>", ""},
+		{"(let ((g (generator (yield 1) (yield 2)))) (list (next g) (next g) (next g)))", "(1 2 ())", ""},
+		{"(let ((g (generator (+ 1 (yield 1))))) (next g) (list (next g 2) (done? g)))", "(() t)", ""},
+		{"(yield)", "", "yield outside of a generator"},
+		// Concurrency:
+		{"(join (spawn + 1 2))", "3", ""},
+		{"(let ((c (chan 1))) (send c 'x) (recv c))", "x", ""},
+		{"(select (default 1))", "1", ""},
+		{"(select (recv 3 x x))", "", "'3' is not a channel"},
+		{"(recv 3)", "", "'3' is not a channel"},
+		{"(deref (future (+ 1 2)))", "3", ""},
+		{"(deref (future (error '(oops))))", "", "(future)"},
+		{"(let ((p (promise))) (deliver p 1) (deref p))", "1", ""},
+		{"(pmap inc (range 5))", "(1 2 3 4 5)", ""},
+		// Threads forcing a delay at once wait for it to be forced once:
+		{"(def pd (let ((n 0)) (delay (sleep 20) (set! n (+ n 1)))))", "<delay>", ""},
+		{"(pmap (lambda (_) (force pd)) (range 4))", "(1 1 1 1)", ""},
+		{"(preduce + (range 5))", "10", ""},
+		// Macros redefined as functions after compilation:
+		{"((lambda () (defmacro m2 (x) 3) (defn m2 (x) x) (m2 4)))", "4", ""},
+		// Function bodies see macro redefinitions:
+		{"(defmacro m3 () 1)", "()", ""},
+		{"(defn use-m3 () (m3))", "()", ""},
+		{"(use-m3)", "1", ""},
+		{"(defmacro m3 () 2)", "()", ""},
+		{"(use-m3)", "2", ""},
+		{"(defn m3 () 3)", "()", ""},
+		{"(use-m3)", "3", ""},
+		// Local variables, by lexical address and by name:
+		{"(let ((x 1) (y 2)) (let ((x 3)) (list x y)))", "(3 2)", ""},
+		{"(let ((x 1)) (set! x 2) x)", "2", ""},
+		{"(let ((x 1)) (eval 'x))", "1", ""},
+		{"((lambda (x) (eval '(set! x 5)) x) 4)", "5", ""},
+		{"((lambda (x) ((lambda h (n) (cond ((zero? n) x) (t (h (- n 1))))) 3)) 8)", "8", ""},
+		{"(let ((t 1)) t)", "", "cannot bind or set t"},
+		// Named lambdas don't bind their names where they're created:
+		{"((lambda nl1 () 1))", "1", ""},
+		{"nl1", "", "unknown symbol: nl1"},
+		{"(letfn ((f (n) (cond ((zero? n) 'done) (t (g (- n 1))))) (g (n) (f n))) (f 200000))", "done", ""},
+		// Continuations outliving the evaluation which captured them:
+		{"(def kk ())", "()", ""},
+		{"(+ 1 (call/cc (lambda (k) (set! kk k) 1)))", "2", ""},
+		{"(kk 5)", "6", ""},
+		// Malformed forms only fail when reached:
+		{"(cond (() (let)) (t 5))", "5", ""},
+		{"(cond (t (let)))", "", "let requires a binding list"},
+		// Errors unwind through nested calls back to the handler:
+		{"(try ((lambda () (+ 1 (car 2)))) (catch e 6))", "6", ""},
+		{"(swallow ((lambda () (error '(oops)))))", "t", ""},
+		// Cleanup code runs on the way out of blocks and nested VMs:
+		{"(block b (apply (lambda () (unwind-protect (return-from b 1) (def up 2))) ()))", "1", ""},
+		{"up", "2", ""},
+		// Special variables are restored when binding exits through a nested VM:
+		{"(defvar *sv* 1)", "1", ""},
+		{"(block b (binding ((*sv* 2)) (map (lambda (x) (return-from b *sv*)) '(1))))", "2", ""},
+		{"*sv*", "1", ""},
+		// Deep tail recursion doesn't grow the frame stack:
+		{"((lambda f (n) (cond ((zero? n) 7) (t (f (- n 1))))) 100000)", "7", ""},
+		// ... nor do tail calls via apply, and, or, try and catch:
+		{"((lambda f (n) (cond ((zero? n) 8) (t (apply f (list (- n 1)))))) 200000)", "8", ""},
+		{"((lambda f (n) (or (zero? n) (f (- n 1)))) 200000)", "t", ""},
+		{"((lambda f (n) (and (< 0 n) (f (- n 1)))) 200000)", "()", ""},
+		{"((lambda f (n) (cond ((zero? n) 9) (t (try (f (- n 1)))))) 200000)", "9", ""},
+		{"((lambda f (n) (try (car n) (catch e (cond ((zero? n) 10) (t (f (- n 1))))))) 200000)", "10", ""},
+		// ... and between the bodies of multi-arity functions:
+		{"((lambda f &arities ((n) (f n 0)) ((n acc) (cond ((zero? n) acc) (t (f (- n 1) (+ acc 1)))))) 200000)", "200000", ""},
+		// Defaults are evaluated at call time, after earlier arguments are bound:
+		{"((lambda (x &optional (y (* x 2)) &key (z (+ x y))) (list x y z)) 3)", "(3 6 9)", ""},
+		{"((lambda (x &optional (y (* x 2)) &key (z (+ x y))) (list x y z)) 3 1 :z 2)", "(3 1 2)", ""},
+		{"(defvar *dflt* 1)", "1", ""},
+		{"(binding ((*dflt* 2)) ((lambda (&optional (x *dflt*)) x)))", "2", ""},
+		// Patterns in arguments are destructured before defaults are computed:
+		{"((lambda ((a . b) &optional (c (len b))) (list a c)) '(1 2 3))", "(1 2)", ""},
+		{"((lambda ((a b)) a) '(1))", "", "(lambda ((a b))) (pattern (a b) does not match (1))"},
+		// Stacktraces include the failing lambda body form:
+		{"((lambda () (/ 1 0) 1))", "", "(lambda (/ 1 0))"},
+	}
+	for _, test := range tests {
+		got, err := lexAndParse(strings.Split(test.in, "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev, err := eval(got[0], &globals)
+		if err != nil {
+			if test.err == "" || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %q, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("%s: expected error %q, got none", test.in, test.err)
+			continue
+		}
+		if ev.String() != test.out {
+			t.Errorf("%s: got %q, want %q", test.in, ev, test.out)
+		}
+	}
+}
+
+// Without a maximum set, deep (non-tail) recursion is limited only by
+// memory, as VM frames live on the heap.
+func TestDeepRecursion(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore, &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"(defn deep (n) (if (zero? n) 0 (+ 1 (deep (- n 1)))))", "()"},
+		{"(deep 1000000)", "1000000"},
+		{"(len (map inc (range 200000)))", "200000"},
+	}
+	for _, test := range tests {
+		got, err := lexAndParse([]string{test.in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev, err := eval(got[0], &globals)
+		if err != nil {
+			t.Errorf("%s: got error %q", test.in, err)
+			continue
+		}
+		if ev.String() != test.out {
+			t.Errorf("%s: got %q, want %q", test.in, ev, test.out)
+		}
+	}
+}
+
+func TestRecursionDepth(t *testing.T) {
+	globals := InitGlobals()
+	err := LexParseEval(RawCore, &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := MaxRecursionDepth
+	MaxRecursionDepth = 100
+	defer func() { MaxRecursionDepth = saved }()
+	err = LexParseEval("(defn deep (n) (if (zero? n) 0 (+ 1 (deep (- n 1)))))", &globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		out string
+		err string
+	}{
+		{"(deep 50)", "50", ""},
+		{"(deep 200)", "", "(maximum recursion depth exceeded)"},
+		// Only the innermost frames are shown:
+		{"(deep 200)", "", "((90 more frames) (lambda (if (zero? n) 0 (+ 1 (deep (- n 1))))) (lambda"},
+		{"(try (deep 200) (catch e (car (reverse e))))", "(maximum recursion depth exceeded)", ""},
+		{"(deep 50)", "50", ""},
+		// Recursion through apply and eval counts too:
+		{"((lambda f (n) (+ 1 (apply f (list n)))) 1)", "", "(maximum recursion depth exceeded)"},
+		{"((lambda f (n) (+ 1 (eval '(f n)))) 1)", "", "(maximum recursion depth exceeded)"},
+	}
+	for _, test := range tests {
+		got, err := lexAndParse([]string{test.in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev, err := eval(got[0], &globals)
+		if err != nil {
+			if test.err == "" || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %q, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("%s: expected error %q, got none", test.in, test.err)
+			continue
+		}
+		if ev.String() != test.out {
+			t.Errorf("%s: got %q, want %q", test.in, ev, test.out)
+		}
+	}
+}
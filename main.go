@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"runtime/pprof"
+	"time"
 
 	"github.com/eigenhombre/l1/lisp"
 )
 
+// Limits on each evaluation (a file, an -e expression or a REPL entry):
+var timeout time.Duration
+var maxSteps int
+
+func limitedContext() (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.Background(), func() {}
+}
+
 func repl(e *lisp.Env) {
 top:
 	for {
@@ -42,7 +55,9 @@ top:
 			fmt.Printf("%v\n", err)
 			continue
 		}
-		lisp.EvalExprs(exprs, e, true)
+		ctx, cancel := limitedContext()
+		lisp.EvalExprsContext(ctx, exprs, e, true, maxSteps)
+		cancel()
 	}
 }
 
@@ -54,6 +69,9 @@ func main() {
 	flag.StringVar(&evalExpr, "e", "", "Evaluate expression")
 	flag.BoolVar(&docFlag, "doc", false, "Print documentation")
 	flag.BoolVar(&longDocFlag, "longdoc", false, "Print documentation")
+	flag.DurationVar(&timeout, "timeout", 0, "Stop each evaluation after this long (e.g. 10s)")
+	flag.IntVar(&maxSteps, "max-steps", 0, "Stop each evaluation after this many steps")
+	flag.IntVar(&lisp.MaxRecursionDepth, "max-depth", lisp.MaxRecursionDepth, "Maximum depth of nested function calls (0 for no limit)")
 
 	flag.Parse()
 
@@ -94,7 +112,9 @@ func main() {
 		os.Exit(0)
 	}
 	if evalExpr != "" {
-		err = lisp.LexParseEval(evalExpr, &globals)
+		ctx, cancel := limitedContext()
+		err = lisp.LexParseEvalContext(ctx, evalExpr, &globals, maxSteps)
+		cancel()
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -105,7 +125,9 @@ func main() {
 	files := flag.Args()
 	if len(files) > 0 {
 		for _, file := range files {
-			err := lisp.LoadFile(&globals, file)
+			ctx, cancel := limitedContext()
+			err := lisp.LoadFileContext(ctx, &globals, file, maxSteps)
+			cancel()
 			if err != nil {
 				fmt.Printf("ERROR:\n%v\n", err)
 				os.Exit(1)